@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/chenjia404/p2ptunnel/p2pforwarder"
+	"go.yaml.in/yaml/v2"
+)
+
+// config describes ports to open and connections to make, it is loaded from -config file
+// or assembled from command line flags
+type config struct {
+	P2PPort   int      `yaml:"p2p_port"`
+	SwarmKey  string   `yaml:"swarm_key"`
+	Bootstrap []string `yaml:"bootstrap"`
+	Offline   bool     `yaml:"offline"`
+	Control   string   `yaml:"control"`
+
+	Relays     []string `yaml:"relays"`
+	RelayNode  bool     `yaml:"relay_node"`
+	RelayPeers []string `yaml:"relay_peers"`
+
+	HolePunching *bool `yaml:"hole_punching"`
+	MDNS         *bool `yaml:"mdns"`
+
+	Ports       []portConfig       `yaml:"ports"`
+	Connections []connectionConfig `yaml:"connections"`
+
+	Broadcast []broadcastConfig `yaml:"broadcast"`
+
+	Proxy *proxyConfig `yaml:"proxy"`
+}
+
+// proxyConfig lets connected peers reach Destinations of this machine's network with their socks5 server
+type proxyConfig struct {
+	Destinations []string `yaml:"destinations"`
+	Allow        []string `yaml:"allow"`
+	Secret       string   `yaml:"secret"`
+}
+
+// broadcastConfig is udp port to relay LAN broadcasts of, Group also relays the multicast group.
+// Allow lists peers connected to this node which exchange them, peers this node connects to always do
+type broadcastConfig struct {
+	Port  uint16   `yaml:"port"`
+	Group string   `yaml:"group"`
+	Allow []string `yaml:"allow"`
+}
+
+// portConfig and connectionConfig are also used by the control api
+type portConfig struct {
+	Type   string   `yaml:"type" json:"type"`
+	Port   uint16   `yaml:"port" json:"port"`
+	Target string   `yaml:"target" json:"target,omitempty"`
+	Allow  []string `yaml:"allow" json:"allow,omitempty"`
+	Secret string   `yaml:"secret" json:"secret,omitempty"`
+
+	Name        string `yaml:"name" json:"name,omitempty"`
+	Description string `yaml:"description" json:"description,omitempty"`
+	Proto       string `yaml:"proto" json:"proto,omitempty"`
+
+	ProxyProtocol int `yaml:"proxy_protocol" json:"proxy_protocol,omitempty"`
+
+	udpSessionConfig `yaml:",inline"`
+}
+
+type connectionConfig struct {
+	ID       string            `yaml:"id" json:"id"`
+	IP       string            `yaml:"ip" json:"ip,omitempty"`
+	Secret   string            `yaml:"secret" json:"secret,omitempty"`
+	Services []string          `yaml:"services" json:"services,omitempty"`
+	Map      map[uint16]uint16 `yaml:"map" json:"map,omitempty"`
+	Sockets  map[uint16]string `yaml:"sockets" json:"sockets,omitempty"`
+	SOCKS5   string            `yaml:"socks5" json:"socks5,omitempty"`
+
+	udpSessionConfig `yaml:",inline"`
+}
+
+// udpSessionConfig limits UDP sessions of ports, zero values mean defaults
+type udpSessionConfig struct {
+	UDPIdleTimeout string `yaml:"udp_idle_timeout" json:"udp_idle_timeout,omitempty"`
+	UDPMaxSessions int    `yaml:"udp_max_sessions" json:"udp_max_sessions,omitempty"`
+}
+
+func (uc *udpSessionConfig) idleTimeout() (time.Duration, error) {
+	if uc.UDPIdleTimeout == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(uc.UDPIdleTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid udp_idle_timeout %q: %s", uc.UDPIdleTimeout, err)
+	}
+
+	return d, nil
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(config)
+
+	err = yaml.UnmarshalStrict(b, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %s", path, err)
+	}
+
+	return cfg, nil
+}
+
+func (cfg *config) forwarderOptions() (*p2pforwarder.Options, error) {
+	opts := &p2pforwarder.Options{}
+
+	var err error
+
+	if cfg.SwarmKey != "" {
+		opts.SwarmKey, err = p2pforwarder.LoadSwarmKey(cfg.SwarmKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opts.BootstrapPeers, err = parseAddrInfos(cfg.Bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Offline = cfg.Offline
+
+	opts.StaticRelays, err = parseAddrInfos(cfg.Relays)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.RelayNode = cfg.RelayNode
+	opts.RelayPeers, err = parsePeerIDs(cfg.RelayPeers)
+	if err != nil {
+		return nil, err
+	}
+	opts.DisableMDNS = cfg.MDNS != nil && !*cfg.MDNS
+	opts.DisableHolePunching = cfg.HolePunching != nil && !*cfg.HolePunching
+
+	return opts, nil
+}
+
+func (pc *portConfig) options() (*p2pforwarder.PortOptions, error) {
+	allowedPeers, err := parsePeerIDs(pc.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	udpIdleTimeout, err := pc.idleTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	return &p2pforwarder.PortOptions{
+		AllowedPeers: allowedPeers,
+		Secret:       pc.Secret,
+		Target:       pc.Target,
+
+		Name:        pc.Name,
+		Description: pc.Description,
+		Proto:       pc.Proto,
+
+		ProxyProtocol: pc.ProxyProtocol,
+
+		UDPIdleTimeout: udpIdleTimeout,
+		UDPMaxSessions: pc.UDPMaxSessions,
+	}, nil
+}
+
+func (pc *proxyConfig) options() (*p2pforwarder.ProxyOptions, error) {
+	allowedPeers, err := parsePeerIDs(pc.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p2pforwarder.ProxyOptions{
+		Destinations: pc.Destinations,
+		AllowedPeers: allowedPeers,
+		Secret:       pc.Secret,
+	}, nil
+}
+
+func (bc *broadcastConfig) options() (*p2pforwarder.BroadcastOptions, error) {
+	allowedPeers, err := parsePeerIDs(bc.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p2pforwarder.BroadcastOptions{
+		Group:        bc.Group,
+		AllowedPeers: allowedPeers,
+	}, nil
+}
+
+func (cc *connectionConfig) options() (*p2pforwarder.ConnectOptions, error) {
+	udpIdleTimeout, err := cc.idleTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	return &p2pforwarder.ConnectOptions{
+		Secret:   cc.Secret,
+		Services: cc.Services,
+		PortMap:  cc.Map,
+
+		UnixSockets: cc.Sockets,
+		SOCKS5:      cc.SOCKS5,
+
+		UDPIdleTimeout: udpIdleTimeout,
+		UDPMaxSessions: cc.UDPMaxSessions,
+	}, nil
+}
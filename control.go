@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chenjia404/p2ptunnel/p2pforwarder"
+	"github.com/sparkymat/appdir"
+)
+
+const defaultControlAddr = "127.0.0.1:4080"
+
+var errControlNotLoopback = errors.New("control api must listen on a loopback address")
+
+// Every control api request must carry the token stored next to the keypair
+// as "Authorization: Bearer TOKEN", so web pages and other users of the machine
+// can not use the api. Requests with bodies must be application/json and the
+// Host must be loopback, so browsers can not send them without preflight or
+// reach the api through DNS rebinding.
+const controlTokenLen = 32
+
+func controlTokenPath() (string, error) {
+	return appdir.AppInfo{
+		Author: "nickname32",
+		Name:   "P2P Forwarder",
+	}.ConfigPath("control_token")
+}
+
+// loadControlToken reads control api token, it is created when `create` is set and the file is missing
+func loadControlToken(create bool) (string, error) {
+	path, err := controlTokenPath()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !os.IsNotExist(err) || !create {
+		return "", err
+	}
+
+	tb := make([]byte, controlTokenLen)
+	_, err = rand.Read(tb)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(tb)
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(path, []byte(token), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// isLoopbackHost reports whether `hostport` of request Host header is a loopback address
+func isLoopbackHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkControlRequest rejects requests of other origins and without the token
+func checkControlRequest(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackHost(r.Host) {
+			http.Error(w, "host must be a loopback address", http.StatusForbidden)
+			return
+		}
+
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			http.Error(w, "invalid control token", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type status struct {
+	ID          string             `json:"id"`
+	Ports       []portConfig       `json:"ports"`
+	Connections []connectionStatus `json:"connections"`
+	LANPeers    []lanPeerStatus    `json:"lan_peers"`
+
+	UDP []p2pforwarder.UDPStats `json:"udp"`
+}
+
+type connectionStatus struct {
+	connectionConfig
+	ListenIP string `json:"listen_ip"`
+	// Path is like "direct ADDR" or "relayed ADDR", empty when disconnected
+	Path string `json:"path"`
+}
+
+type lanPeerStatus struct {
+	ID    string   `json:"id"`
+	Addrs []string `json:"addrs"`
+}
+
+// serveControl starts http/json control api of the running daemon on loopback `addr`
+func serveControl(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errControlNotLoopback
+	}
+
+	token, err := loadControlToken(true)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", handleStatus)
+	mux.HandleFunc("POST /ports", handleOpenPort)
+	mux.HandleFunc("DELETE /ports", handleClosePort)
+	mux.HandleFunc("POST /connections", handleConnect)
+	mux.HandleFunc("DELETE /connections", handleDisconnect)
+
+	log.Println("Control api is listened on " + ln.Addr().String())
+
+	go func() {
+		err := http.Serve(ln, checkControlRequest(token, mux))
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	return nil
+}
+
+func currentStatus() *status {
+	st := &status{
+		ID:          fwr.ID(),
+		Ports:       []portConfig{},
+		Connections: []connectionStatus{},
+		LANPeers:    []lanPeerStatus{},
+
+		UDP: fwr.UDPStats(),
+	}
+
+	for _, pi := range fwr.LANPeers() {
+		lp := lanPeerStatus{
+			ID:    pi.ID.String(),
+			Addrs: []string{},
+		}
+		for _, addr := range pi.Addrs {
+			lp.Addrs = append(lp.Addrs, addr.String())
+		}
+		st.LANPeers = append(st.LANPeers, lp)
+	}
+
+	stateMux.Lock()
+	for _, portsMap := range []map[uint]*openedPort{openTCPPorts, openUDPPorts, openUnixPorts} {
+		for _, op := range portsMap {
+			pc := op.config
+			pc.Secret = ""
+			st.Ports = append(st.Ports, pc)
+		}
+	}
+	for _, conn := range connections {
+		cc := conn.config
+		cc.Secret = ""
+		st.Connections = append(st.Connections, connectionStatus{
+			connectionConfig: cc,
+			ListenIP:         conn.listenip,
+			Path:             fwr.ConnPath(cc.ID),
+		})
+	}
+	stateMux.Unlock()
+
+	sort.Slice(st.Ports, func(i, j int) bool {
+		if st.Ports[i].Type != st.Ports[j].Type {
+			return st.Ports[i].Type < st.Ports[j].Type
+		}
+		return st.Ports[i].Port < st.Ports[j].Port
+	})
+	sort.Slice(st.Connections, func(i, j int) bool {
+		return st.Connections[i].ID < st.Connections[j].ID
+	})
+
+	return st
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, currentStatus())
+}
+
+func handleOpenPort(w http.ResponseWriter, r *http.Request) {
+	pc := new(portConfig)
+
+	err := json.NewDecoder(r.Body).Decode(pc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = openPort(pc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Opened %s port %d\n", pc.Type, pc.Port)
+
+	writeJSON(w, currentStatus())
+}
+
+func handleClosePort(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.ParseUint(r.URL.Query().Get("port"), 10, 16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	networkType := r.URL.Query().Get("type")
+
+	err = closePort(networkType, uint16(port))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Closed %s port %d\n", networkType, port)
+
+	writeJSON(w, currentStatus())
+}
+
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	cc := new(connectionConfig)
+
+	err := json.NewDecoder(r.Body).Decode(cc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = connect(cc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	writeJSON(w, currentStatus())
+}
+
+func handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+
+	err := disconnect(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Disconnected from %s\n", id)
+
+	writeJSON(w, currentStatus())
+}
+
+// runCtl runs `p2ptunnel ctl` subcommands, which call control api of the running daemon
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	control := fs.String("control", defaultControlAddr, "control api address of the running daemon")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: p2ptunnel ctl [-control addr] status|open|close|connect|disconnect [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cmd := fs.Arg(0)
+	cmdFs := flag.NewFlagSet("ctl "+cmd, flag.ExitOnError)
+
+	base := "http://" + *control
+
+	var (
+		method = http.MethodGet
+		path   string
+		body   interface{}
+	)
+
+	switch cmd {
+	case "status":
+		path = "/status"
+		cmdFs.Parse(fs.Args()[1:])
+	case "open", "close":
+		networkType := cmdFs.String("type", "tcp", "network type tcp/udp/unix")
+		port := cmdFs.Uint("l", 0, "port")
+		target := cmdFs.String("target", "", "forward the port to host:port instead of the same local port, socket path for unix ports")
+		allow := cmdFs.String("allow", "", "comma separated peer ids allowed to connect, empty allows everyone")
+		secret := cmdFs.String("secret", "", "shared secret required to connect")
+		name := cmdFs.String("name", "", "service name")
+		desc := cmdFs.String("desc", "", "service description")
+		proto := cmdFs.String("proto", "", "application protocol hint")
+		proxyProtocol := cmdFs.Int("proxy_protocol", 0, "PROXY protocol version (1 or 2) of the header sent to the port")
+		udpIdleTimeout := cmdFs.String("udp_idle_timeout", "", "close udp sessions with no datagrams for this time")
+		udpMaxSessions := cmdFs.Int("udp_max_sessions", 0, "max number of udp sessions of the port")
+		cmdFs.Parse(fs.Args()[1:])
+
+		path = "/ports"
+		if cmd == "open" {
+			method = http.MethodPost
+			body = &portConfig{
+				Type:   *networkType,
+				Port:   uint16(*port),
+				Target: *target,
+				Allow:  splitList(*allow),
+				Secret: *secret,
+
+				Name:        *name,
+				Description: *desc,
+				Proto:       *proto,
+
+				ProxyProtocol: *proxyProtocol,
+
+				udpSessionConfig: udpSessionConfig{
+					UDPIdleTimeout: *udpIdleTimeout,
+					UDPMaxSessions: *udpMaxSessions,
+				},
+			}
+		} else {
+			method = http.MethodDelete
+			path += "?" + url.Values{
+				"type": {*networkType},
+				"port": {strconv.FormatUint(uint64(*port), 10)},
+			}.Encode()
+		}
+	case "connect", "disconnect":
+		id := cmdFs.String("id", "", "remote peer id or multiaddr ending with /p2p/ID")
+		ip := cmdFs.String("ip", "", "local listen ip")
+		secret := cmdFs.String("secret", "", "shared secret of remote ports")
+		services := cmdFs.String("services", "", "comma separated names of remote services to listen for")
+		portMap := cmdFs.String("map", "", "comma separated remote:local port mappings")
+		sockets := cmdFs.String("sockets", "", "comma separated remote unix port:local socket path mappings")
+		socks5 := cmdFs.String("socks5", "", "run SOCKS5 server on this address which dials destinations through the peer")
+		udpIdleTimeout := cmdFs.String("udp_idle_timeout", "", "close udp sessions with no datagrams for this time")
+		udpMaxSessions := cmdFs.Int("udp_max_sessions", 0, "max number of udp sessions of every remote port")
+		cmdFs.Parse(fs.Args()[1:])
+
+		path = "/connections"
+		if cmd == "connect" {
+			pm, err := parsePortMap(*portMap)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			sm, err := parseSocketMap(*sockets)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			method = http.MethodPost
+			body = &connectionConfig{
+				ID:       *id,
+				IP:       *ip,
+				Secret:   *secret,
+				Services: splitList(*services),
+				Map:      pm,
+				Sockets:  sm,
+				SOCKS5:   *socks5,
+
+				udpSessionConfig: udpSessionConfig{
+					UDPIdleTimeout: *udpIdleTimeout,
+					UDPMaxSessions: *udpMaxSessions,
+				},
+			}
+		} else {
+			method = http.MethodDelete
+			path += "?" + url.Values{"id": {*id}}.Encode()
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	token, err := loadControlToken(false)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("control token: %s", err))
+	}
+
+	req, err := http.NewRequest(method, base+path, reqBody)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("%s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+
+	var out bytes.Buffer
+	err = json.Indent(&out, b, "", "  ")
+	if err != nil {
+		os.Stdout.Write(b)
+		return
+	}
+	out.WriteTo(os.Stdout)
+}
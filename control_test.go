@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckControlRequest(t *testing.T) {
+	const token = "0123456789abcdef"
+
+	tests := []struct {
+		name        string
+		method      string
+		host        string
+		auth        string
+		contentType string
+		want        int
+	}{
+		{name: "valid", method: http.MethodGet, host: "127.0.0.1:4080", auth: "Bearer " + token, want: http.StatusOK},
+		{name: "localhost", method: http.MethodGet, host: "localhost:4080", auth: "Bearer " + token, want: http.StatusOK},
+		{name: "ipv6 loopback", method: http.MethodGet, host: "[::1]:4080", auth: "Bearer " + token, want: http.StatusOK},
+		{name: "valid post", method: http.MethodPost, host: "127.0.0.1:4080", auth: "Bearer " + token, contentType: "application/json; charset=utf-8", want: http.StatusOK},
+		{name: "missing token", method: http.MethodGet, host: "127.0.0.1:4080", want: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodGet, host: "127.0.0.1:4080", auth: "Bearer fedcba9876543210", want: http.StatusUnauthorized},
+		{name: "bare token", method: http.MethodGet, host: "127.0.0.1:4080", auth: token, want: http.StatusUnauthorized},
+		{name: "other scheme", method: http.MethodGet, host: "127.0.0.1:4080", auth: "Basic " + token, want: http.StatusUnauthorized},
+		{name: "non-loopback host", method: http.MethodGet, host: "evil.example:4080", auth: "Bearer " + token, want: http.StatusForbidden},
+		{name: "post without json", method: http.MethodPost, host: "127.0.0.1:4080", auth: "Bearer " + token, contentType: "text/plain", want: http.StatusUnsupportedMediaType},
+	}
+
+	handler := checkControlRequest(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/status", strings.NewReader("{}"))
+			r.Host = tt.host
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckControlRequestEmptyToken(t *testing.T) {
+	handler := checkControlRequest("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest(http.MethodGet, "/status", nil)
+	r.Host = "127.0.0.1:4080"
+	r.Header.Set("Authorization", "Bearer ")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
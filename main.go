@@ -1,21 +1,54 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/chenjia404/p2ptunnel/p2pforwarder"
 	"github.com/chenjia404/p2ptunnel/update"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 var (
-	fwr          *p2pforwarder.Forwarder
-	fwrCancel    func()
-	connections  = make(map[string]func())
-	openTCPPorts = make(map[uint]func())
-	openUDPPorts = make(map[uint]func())
+	fwr           *p2pforwarder.Forwarder
+	fwrCancel     func()
+	connections   = make(map[string]*connection)
+	openTCPPorts  = make(map[uint]*openedPort)
+	openUDPPorts  = make(map[uint]*openedPort)
+	openUnixPorts = make(map[uint]*openedPort)
+	stateMux      sync.Mutex
+)
+
+type openedPort struct {
+	config portConfig
+	cancel func()
+}
+
+type connection struct {
+	config   connectionConfig
+	listenip string
+	cancel   func()
+}
+
+// shutdownTimeout limits waiting for active connections to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
+var (
+	errPortNotOpened    = errors.New("port is not opened")
+	errNotConnected     = errors.New("not connected to this id")
+	errUnknownNetworkID = errors.New("unknown network type, it must be \"tcp\", \"udp\" or \"unix\"")
 )
 
 var (
@@ -25,17 +58,46 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		runCtl(os.Args[2:])
+		return
+	}
 
 	fmt.Printf("p2ptunnel %s-%s\n", version, gitRev)
 	fmt.Printf("buildTime %s\n", buildTime)
 	fmt.Printf("System version: %s\n", runtime.GOARCH+"/"+runtime.GOOS)
 	fmt.Printf("Golang version: %s\n", runtime.Version())
 
-	port := flag.Uint("l", 12000, "listen port")
+	port := flag.Uint("l", 12000, "listen port, 0 opens no port")
 	ip := flag.String("ip", "127.0.0.1", "forwarder to ip or listen ip")
-	id := flag.String("id", "", "Destination multiaddr id string")
+	id := flag.String("id", "", "destination peer id or multiaddr ending with /p2p/ID, which is dialed without DHT lookup")
 	p2p_port := flag.Int("p2p_port", 4001, "p2p use port")
-	networkType := flag.String("type", "tcp", "network type tcp/udp")
+	swarmKey := flag.String("swarm_key", "", "path to swarm.key of a private network, only nodes with the same key can connect")
+	bootstrap := flag.String("bootstrap", "", "comma separated bootstrap peer multiaddrs, replaces the public bootstrap peers")
+	offline := flag.Bool("offline", false, "do not use the public bootstrap peers, nodes are found through -bootstrap, previously connected peers and mDNS, e.g. in a LAN without internet")
+	relays := flag.String("relay", "", "comma separated multiaddrs of your own circuit relays used when this node or the remote one is behind NAT")
+	relayNode := flag.Bool("relay_node", false, "run as circuit relay for your other nodes, use on a node with public ip")
+	relayPeers := flag.String("relay_peers", "", "comma separated ids of your nodes which -relay_node relays without time and data limits, other nodes can not use it then, empty relays everyone with the default limits")
+	holePunching := flag.Bool("holepunch", true, "upgrade relayed connections to direct ones with hole punching")
+	mdns := flag.Bool("mdns", true, "find p2ptunnel nodes on the local network with mDNS and connect to them directly")
+	networkType := flag.String("type", "tcp", "network type tcp/udp/unix, a unix port forwards to the -target socket path")
+	allow := flag.String("allow", "", "comma separated peer ids allowed to connect to the listen port, empty allows everyone")
+	target := flag.String("target", "", "forward the listen port to host:port reachable from this machine instead of the same local port, socket path for -type unix, e.g. /var/run/docker.sock")
+	name := flag.String("name", "", "service name of the listen port shown to connecting peers, e.g. office-rdp")
+	desc := flag.String("desc", "", "service description of the listen port")
+	proto := flag.String("proto", "", "application protocol hint of the listen port, e.g. rdp, ssh, http")
+	proxyProtocol := flag.Int("proxy_protocol", 0, "send PROXY protocol header of this version (1 or 2) to the listen port, so the service sees the peer's ip instead of 127.0.88.89, version 2 also carries the peer id")
+	services := flag.String("services", "", "comma separated names of remote services to listen for, empty listens for all ports")
+	portMap := flag.String("map", "", "comma separated remote:local port mappings to listen on, e.g. 3389:13389,22:2222")
+	proxyAllow := flag.String("proxy_allow", "", "comma separated destinations connected peers may reach through their -socks5 server, CIDR or CIDR:PORTS, e.g. 192.168.1.0/24,10.0.0.5:22,10.0.0.0/8:8000-8100, at least one of -allow and -secret is required")
+	socks5 := flag.String("socks5", "", "run SOCKS5 server on this address which dials destinations through the -id peer, e.g. 127.0.0.1:1080, the peer must allow them with -proxy_allow")
+	sockets := flag.String("sockets", "", "comma separated remote unix port:local socket path mappings to listen on, e.g. 2375:/tmp/docker.sock, unmapped unix ports are listened on tcp")
+	broadcast := flag.String("broadcast", "", "comma separated udp ports to relay LAN broadcasts of between this node and connected peers, PORT/GROUP also relays the multicast group, e.g. 27015,4445/224.0.2.60, peers connecting to this node must be listed in -allow")
+	udpIdleTimeout := flag.String("udp_idle_timeout", "", "close udp sessions with no datagrams for this time, default is "+p2pforwarder.DefaultUDPIdleTimeout.String())
+	udpMaxSessions := flag.Int("udp_max_sessions", 0, "max number of udp sessions of a port, default is "+strconv.Itoa(p2pforwarder.DefaultUDPMaxSessions))
+	secret := flag.String("secret", "", "shared secret required to connect to the listen port or used to connect to remote ports")
+	control := flag.String("control", "", "enable control api on loopback address, e.g. "+defaultControlAddr)
+	configPath := flag.String("config", "", "path to yaml config file with ports to open and connections to make, replaces -l and -id")
 	var flag_update = flag.Bool("update", false, "update form github")
 	flag.Parse()
 
@@ -46,44 +108,417 @@ func main() {
 		return
 	}
 
-	fwr, fwrCancel, err = p2pforwarder.NewForwarder(*p2p_port)
+	broadcasts, err := parseBroadcasts(*broadcast, splitList(*allow))
 	if err != nil {
 		log.Panicln(err)
 	}
 
-	if *id == "" {
+	cfg := &config{
+		P2PPort:   *p2p_port,
+		SwarmKey:  *swarmKey,
+		Bootstrap: splitList(*bootstrap),
+		Offline:   *offline,
+		Control:   *control,
+
+		Relays:     splitList(*relays),
+		RelayNode:  *relayNode,
+		RelayPeers: splitList(*relayPeers),
+
+		HolePunching: holePunching,
+		MDNS:         mdns,
 
-		cancel, err := fwr.OpenPort(*networkType, uint16(*port))
+		Broadcast: broadcasts,
+	}
+
+	if *proxyAllow != "" {
+		cfg.Proxy = &proxyConfig{
+			Destinations: splitList(*proxyAllow),
+			Allow:        splitList(*allow),
+			Secret:       *secret,
+		}
+	}
+
+	if *configPath != "" {
+		err = checkConfigFlags()
 		if err != nil {
 			log.Panicln(err)
-			return
 		}
 
-		log.Println("Your id: " + fwr.ID())
+		cfg, err = loadConfig(*configPath)
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		if cfg.P2PPort == 0 {
+			cfg.P2PPort = *p2p_port
+		}
+		if cfg.Control == "" {
+			cfg.Control = *control
+		}
+		if cfg.MDNS == nil {
+			cfg.MDNS = mdns
+		}
+		if cfg.HolePunching == nil {
+			cfg.HolePunching = holePunching
+		}
+	} else if *id == "" && *port != 0 {
+		cfg.Ports = []portConfig{{
+			Type:   *networkType,
+			Port:   uint16(*port),
+			Target: *target,
+			Allow:  splitList(*allow),
+			Secret: *secret,
+
+			Name:        *name,
+			Description: *desc,
+			Proto:       *proto,
+
+			ProxyProtocol: *proxyProtocol,
+
+			udpSessionConfig: udpSessionConfig{
+				UDPIdleTimeout: *udpIdleTimeout,
+				UDPMaxSessions: *udpMaxSessions,
+			},
+		}}
+	} else if *id != "" {
+		pm, err := parsePortMap(*portMap)
+		if err != nil {
+			log.Panicln(err)
+		}
+		sm, err := parseSocketMap(*sockets)
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		cfg.Connections = []connectionConfig{{
+			ID:       *id,
+			IP:       *ip,
+			Secret:   *secret,
+			Services: splitList(*services),
+			Map:      pm,
+			Sockets:  sm,
+			SOCKS5:   *socks5,
+
+			udpSessionConfig: udpSessionConfig{
+				UDPIdleTimeout: *udpIdleTimeout,
+				UDPMaxSessions: *udpMaxSessions,
+			},
+		}}
+	}
+
+	fwrOpts, err := cfg.forwarderOptions()
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	fwr, fwrCancel, err = p2pforwarder.NewForwarder(cfg.P2PPort, fwrOpts)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	log.Println("Your id: " + fwr.ID())
+
+	for i := range cfg.Ports {
+		err = openPort(&cfg.Ports[i])
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+
+	if cfg.Proxy != nil {
+		proxyOpts, err := cfg.Proxy.options()
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		_, err = fwr.OpenProxy(proxyOpts)
+		if err != nil {
+			log.Panicln(fmt.Errorf("open proxy: %s", err))
+		}
+	}
+
+	for _, bc := range cfg.Broadcast {
+		bcOpts, err := bc.options()
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		_, err = fwr.RelayBroadcast(bc.Port, bcOpts)
+		if err != nil {
+			log.Panicln(fmt.Errorf("relay broadcasts of port %d: %s", bc.Port, err))
+		}
+	}
+
+	for i := range cfg.Connections {
+		_, err = connect(&cfg.Connections[i])
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	if cfg.Control != "" {
+		err = serveControl(cfg.Control)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-sigCh
+	log.Printf("Received %s, shutting down, press Ctrl-C again to exit immediately\n", sig)
+
+	go func() {
+		<-sigCh
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	err = fwr.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		log.Println(err)
+	}
+
+	fwrCancel()
+}
+
+// configFlags are flags which are used together with -config, they apply when the config file does not set them
+var configFlags = map[string]bool{
+	"config":    true,
+	"p2p_port":  true,
+	"control":   true,
+	"mdns":      true,
+	"holepunch": true,
+}
+
+// checkConfigFlags fails on flags set together with -config which the config file replaces,
+// so e.g. -swarm_key is not silently ignored and the node does not join the public network
+func checkConfigFlags() error {
+	var conflicting []string
+	flag.Visit(func(fl *flag.Flag) {
+		if !configFlags[fl.Name] {
+			conflicting = append(conflicting, "-"+fl.Name)
+		}
+	})
+
+	if len(conflicting) > 0 {
+		return fmt.Errorf("%s can not be used with -config, set them in the config file", strings.Join(conflicting, ", "))
+	}
+	return nil
+}
+
+func openPortsMap(networkType string) (map[uint]*openedPort, error) {
+	switch networkType {
+	case "tcp":
+		return openTCPPorts, nil
+	case "udp":
+		return openUDPPorts, nil
+	case "unix":
+		return openUnixPorts, nil
+	}
+	return nil, errUnknownNetworkID
+}
+
+func openPort(pc *portConfig) error {
+	portsMap, err := openPortsMap(pc.Type)
+	if err != nil {
+		return err
+	}
+
+	opts, err := pc.options()
+	if err != nil {
+		return err
+	}
+
+	cancel, err := fwr.OpenPort(pc.Type, pc.Port, opts)
+	if err != nil {
+		return fmt.Errorf("open %s port %d: %s", pc.Type, pc.Port, err)
+	}
+
+	stateMux.Lock()
+	portsMap[uint(pc.Port)] = &openedPort{
+		config: *pc,
+		cancel: cancel,
+	}
+	stateMux.Unlock()
+
+	return nil
+}
+
+func closePort(networkType string, port uint16) error {
+	portsMap, err := openPortsMap(networkType)
+	if err != nil {
+		return err
+	}
+
+	stateMux.Lock()
+	op := portsMap[uint(port)]
+	delete(portsMap, uint(port))
+	stateMux.Unlock()
+
+	if op == nil {
+		return errPortNotOpened
+	}
+
+	op.cancel()
+
+	return nil
+}
+
+func connect(cc *connectionConfig) (listenip string, err error) {
+	opts, err := cc.options()
+	if err != nil {
+		return "", err
+	}
+
+	// Unreachable peer is retried by Connect, so errors are the ones retrying can not fix
+	listenip, cancel, err := fwr.Connect(cc.ID, cc.IP, opts)
+	if err != nil {
+		return "", err
+	}
+
+	stateMux.Lock()
+	connections[cc.ID] = &connection{
+		config:   *cc,
+		listenip: listenip,
+		cancel:   cancel,
+	}
+	stateMux.Unlock()
+
+	log.Printf("Connections to %s's ports are listened on %s\n", cc.ID, listenip)
+
+	return listenip, nil
+}
+
+func disconnect(id string) error {
+	stateMux.Lock()
+	conn := connections[id]
+	delete(connections, id)
+	stateMux.Unlock()
+
+	if conn == nil {
+		return errNotConnected
+	}
+
+	conn.cancel()
+
+	return nil
+}
+
+// splitList splits comma separated list skipping empty items
+func splitList(s string) []string {
+	var list []string
 
-		switch *networkType {
-		case "tcp":
-			openTCPPorts[*port] = cancel
-		case "udp":
-			openUDPPorts[*port] = cancel
+	for _, str := range strings.Split(s, ",") {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
 		}
-	} else {
-		listenip, cancel, err := fwr.Connect(*id, *ip)
+
+		list = append(list, str)
+	}
+
+	return list
+}
+
+// parsePeerIDs parses list of peer ids
+func parsePeerIDs(list []string) ([]peer.ID, error) {
+	var peerids []peer.ID
+
+	for _, str := range list {
+		peerid, err := peer.Decode(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer id %q: %s", str, err)
+		}
+
+		peerids = append(peerids, peerid)
+	}
+
+	return peerids, nil
+}
+
+// parsePortMap parses comma separated list of remote:local port pairs
+func parsePortMap(s string) (map[uint16]uint16, error) {
+	portMap := make(map[uint16]uint16)
+
+	for _, str := range splitList(s) {
+		remote, local, ok := strings.Cut(str, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid port mapping %q: expected remote:local", str)
+		}
+
+		remotePort, err := strconv.ParseUint(remote, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port mapping %q: %s", str, err)
+		}
+		localPort, err := strconv.ParseUint(local, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port mapping %q: %s", str, err)
+		}
+
+		portMap[uint16(remotePort)] = uint16(localPort)
+	}
+
+	return portMap, nil
+}
+
+// parseSocketMap parses comma separated list of remote port:local socket path pairs
+func parseSocketMap(s string) (map[uint16]string, error) {
+	socketMap := make(map[uint16]string)
+
+	for _, str := range splitList(s) {
+		remote, path, ok := strings.Cut(str, ":")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid socket mapping %q: expected port:path", str)
+		}
+
+		remotePort, err := strconv.ParseUint(remote, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket mapping %q: %s", str, err)
+		}
+
+		socketMap[uint16(remotePort)] = path
+	}
+
+	return socketMap, nil
+}
+
+// parseBroadcasts parses comma separated list of PORT or PORT/GROUP items, `allow` is set for all of them
+func parseBroadcasts(s string, allow []string) ([]broadcastConfig, error) {
+	var broadcasts []broadcastConfig
+
+	for _, str := range splitList(s) {
+		portStr, group, _ := strings.Cut(str, "/")
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
 		if err != nil {
-			log.Printf("Connect id:%s ip:%s\n", *id, *ip)
-			listenip, cancel, err = fwr.Connect(*id, *ip)
-			if err != nil {
-				log.Println(err)
-				//log.Panicln(err)
-				//todo 使用中继连接
-				//return
-			}
+			return nil, fmt.Errorf("invalid broadcast port %q: %s", str, err)
 		}
 
-		connections[*id] = cancel
+		broadcasts = append(broadcasts, broadcastConfig{
+			Port:  uint16(port),
+			Group: group,
+			Allow: allow,
+		})
+	}
+
+	return broadcasts, nil
+}
+
+// parseAddrInfos parses list of multiaddrs ending with /p2p/ID
+func parseAddrInfos(list []string) ([]peer.AddrInfo, error) {
+	var addrs []ma.Multiaddr
+
+	for _, str := range list {
+		addr, err := ma.NewMultiaddr(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multiaddr %q: %s", str, err)
+		}
 
-		log.Printf("Connections to %s's ports are listened on %s\n", id, listenip)
+		addrs = append(addrs, addr)
 	}
 
-	select {}
+	return peer.AddrInfosFromP2pAddrs(addrs...)
 }
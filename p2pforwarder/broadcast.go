@@ -0,0 +1,399 @@
+package p2pforwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-reuseport"
+	"golang.org/x/net/ipv4"
+)
+
+// LAN games find servers with UDP broadcast or multicast, which can not be
+// forwarded to a unicast listen address. Broadcast relay of a port captures
+// such datagrams on this machine's LAN and sends them to peers this node
+// connected to with Connect and to allowed peers connected to this node.
+// Peers relaying the same port re-emit them on their LAN to the relayed group
+// or the limited broadcast address, so local apps and other machines receive them. Every datagram
+// goes in its own stream as big-endian uint16 port, IPv4 destination address
+// and the datagram until EOF. Replies to the re-emitted datagrams are not
+// relayed back.
+const broadcastProtID protocol.ID = "/p2pforwarder/broadcast/1.0.0"
+
+const (
+	// broadcastSendTimeout limits sending a datagram to a peer
+	broadcastSendTimeout = 5 * time.Second
+
+	// broadcastEchoWindow is time a sent datagram is not sent again for. Relays of
+	// other nodes on the same LAN re-emit it, and it would loop between them otherwise
+	broadcastEchoWindow = 250 * time.Millisecond
+)
+
+var (
+	// ErrBroadcastAlreadyRelayed = error "Broadcasts of the port are already relayed"
+	ErrBroadcastAlreadyRelayed = errors.New("Broadcasts of the port are already relayed")
+	// ErrInvalidMulticastGroup = error "Multicast group must be an IPv4 multicast address"
+	ErrInvalidMulticastGroup = errors.New("Multicast group must be an IPv4 multicast address")
+)
+
+// BroadcastOptions - optional settings of RelayBroadcast
+type BroadcastOptions struct {
+	// Group is IPv4 multicast group to join, e.g. "224.0.2.60", empty means broadcast only
+	Group string
+
+	// AllowedPeers connected to this node exchange datagrams too, empty allows none of them.
+	// Peers this node connected to with Connect always do
+	AllowedPeers []peer.ID
+}
+
+type broadcastRelay struct {
+	port  uint16
+	group net.IP
+
+	// allowedPeers connected to this node exchange datagrams
+	allowedPeers map[peer.ID]struct{}
+
+	// conn captures datagrams sent to the port, it shares the port with local apps
+	conn *ipv4.PacketConn
+	// hasDst is false when destination of captured datagrams is unknown on this platform
+	hasDst bool
+
+	// emit sends datagrams received from peers, datagrams it sent are not captured again
+	emit *net.UDPConn
+}
+
+// RelayBroadcast captures broadcast and multicast datagrams sent to `port` on this machine's LAN,
+// sends them to peers connected with Connect and opts.AllowedPeers connected to this node and
+// re-emits datagrams of `port` received from them, opts may be nil. Peers must relay the same
+// port to re-emit the datagrams
+func (f *Forwarder) RelayBroadcast(port uint16, opts *BroadcastOptions) (cancel func(), err error) {
+	if opts == nil {
+		opts = &BroadcastOptions{}
+	}
+
+	r := &broadcastRelay{port: port}
+
+	if opts.Group != "" {
+		r.group = net.ParseIP(opts.Group).To4()
+		if r.group == nil || !r.group.IsMulticast() {
+			return nil, ErrInvalidMulticastGroup
+		}
+	}
+
+	r.allowedPeers = make(map[peer.ID]struct{}, len(opts.AllowedPeers))
+	for _, peerid := range opts.AllowedPeers {
+		r.allowedPeers[peerid] = struct{}{}
+	}
+
+	f.broadcastsMux.Lock()
+	defer f.broadcastsMux.Unlock()
+
+	if f.broadcasts[port] != nil {
+		return nil, ErrBroadcastAlreadyRelayed
+	}
+
+	pc, err := reuseport.ListenPacket("udp4", ":"+strconv.Itoa(int(port)))
+	if err != nil {
+		return nil, err
+	}
+	r.conn = ipv4.NewPacketConn(pc)
+
+	// Without destination every datagram of the port is relayed, e.g. on Windows
+	r.hasDst = r.conn.SetControlMessage(ipv4.FlagDst, true) == nil
+
+	if r.group != nil {
+		err = joinGroup(r.conn, r.group)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+
+	r.emit, err = net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	f.broadcasts[port] = r
+
+	ctx, cancelfn := context.WithCancel(f.ctx)
+
+	go f.captureBroadcasts(r)
+
+	go func() {
+		<-ctx.Done()
+
+		f.broadcastsMux.Lock()
+		delete(f.broadcasts, port)
+		f.broadcastsMux.Unlock()
+
+		r.conn.Close()
+		r.emit.Close()
+	}()
+
+	onInfoFn("Relaying broadcasts of udp:" + strconv.Itoa(int(port)))
+
+	return cancelfn, nil
+}
+
+// joinGroup joins `group` on every multicast interface, it fails when none of them can join
+func joinGroup(conn *ipv4.PacketConn, group net.IP) error {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	err = fmt.Errorf("join %s: no multicast interfaces", group)
+	joined := false
+
+	for i := range ifis {
+		if ifis[i].Flags&net.FlagUp == 0 || ifis[i].Flags&net.FlagMulticast == 0 {
+			continue
+		}
+
+		jerr := conn.JoinGroup(&ifis[i], &net.UDPAddr{IP: group})
+		if jerr != nil {
+			err = fmt.Errorf("join %s on %s: %s", group, ifis[i].Name, jerr)
+			continue
+		}
+		joined = true
+	}
+
+	if joined {
+		return nil
+	}
+	return err
+}
+
+// isBroadcastIP reports whether `ip` is the limited broadcast address or a broadcast address of a local network
+func isBroadcastIP(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+	if ip.Equal(net.IPv4bcast) {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+			continue
+		}
+
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = ipnet.IP.To4()[i] | ^ipnet.Mask[i]
+		}
+		if ip.Equal(bcast) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLocalIP reports whether `ip` belongs to this machine
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *Forwarder) captureBroadcasts(r *broadcastRelay) {
+	emitPort := r.emit.LocalAddr().(*net.UDPAddr).Port
+
+	// sent holds hashes of datagrams sent within broadcastEchoWindow
+	sent := make(map[uint64]time.Time)
+
+	buf := make([]byte, maxDatagramLen)
+
+	for {
+		n, cm, src, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if f.ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				onErrFn(fmt.Errorf("broadcast: %s", err))
+			}
+			return
+		}
+
+		// Datagrams re-emitted by this relay come back to it
+		srcAddr, ok := src.(*net.UDPAddr)
+		if !ok || srcAddr.Port == emitPort && isLocalIP(srcAddr.IP) {
+			continue
+		}
+
+		var dst net.IP
+		if r.hasDst && cm != nil {
+			dst = cm.Dst.To4()
+			if dst == nil || !dst.IsMulticast() && !isBroadcastIP(dst) {
+				continue
+			}
+		}
+
+		h := fnv.New64a()
+		h.Write(buf[:n])
+		sum := h.Sum64()
+
+		now := time.Now()
+		if t, ok := sent[sum]; ok && now.Sub(t) < broadcastEchoWindow {
+			continue
+		}
+		for k, t := range sent {
+			if now.Sub(t) >= broadcastEchoWindow {
+				delete(sent, k)
+			}
+		}
+		sent[sum] = now
+
+		b := make([]byte, n)
+		copy(b, buf[:n])
+
+		for _, peerid := range f.broadcastPeers(r) {
+			go f.sendBroadcast(peerid, r.port, dst, b)
+		}
+	}
+}
+
+// broadcastPeers returns peers this node connected to with Connect and allowed peers of `r` connected to it.
+// Any peer can subscribe to ports, so other subscribers must not get LAN datagrams
+func (f *Forwarder) broadcastPeers(r *broadcastRelay) []peer.ID {
+	seen := make(map[peer.ID]struct{})
+
+	f.portsSubscriptionsMux.Lock()
+	for peerid := range f.portsSubscriptions {
+		seen[peerid] = struct{}{}
+	}
+	f.portsSubscriptionsMux.Unlock()
+
+	now := time.Now()
+
+	f.portsSubscribersMux.Lock()
+	for peerid, expires := range f.portsSubscribers {
+		if _, ok := r.allowedPeers[peerid]; ok && now.Before(expires) {
+			seen[peerid] = struct{}{}
+		}
+	}
+	f.portsSubscribersMux.Unlock()
+
+	peers := make([]peer.ID, 0, len(seen))
+	for peerid := range seen {
+		peers = append(peers, peerid)
+	}
+
+	return peers
+}
+
+func (f *Forwarder) isBroadcastPeer(r *broadcastRelay, peerid peer.ID) bool {
+	for _, p := range f.broadcastPeers(r) {
+		if p == peerid {
+			return true
+		}
+	}
+	return false
+}
+
+// sendBroadcast sends datagram `b` sent to `dst`:`port` to `peerid`, nil `dst` means it is unknown.
+// Peers of older versions do not support the protocol, so errors are not reported
+func (f *Forwarder) sendBroadcast(peerid peer.ID, port uint16, dst net.IP, b []byte) {
+	ctx, cancel := context.WithTimeout(f.ctx, broadcastSendTimeout)
+	defer cancel()
+
+	s, err := f.newStream(ctx, peerid, broadcastProtID)
+	if err != nil {
+		return
+	}
+
+	frame := make([]byte, 2+net.IPv4len+len(b))
+	binary.BigEndian.PutUint16(frame, port)
+	if dst != nil {
+		copy(frame[2:], dst)
+	}
+	copy(frame[2+net.IPv4len:], b)
+
+	_, err = s.Write(frame)
+	if err != nil {
+		s.Reset()
+		return
+	}
+
+	s.Close()
+}
+
+func setBroadcastHandler(f *Forwarder) {
+	f.host.SetStreamHandler(broadcastProtID, func(s network.Stream) {
+		defer s.Close()
+
+		header := make([]byte, 2+net.IPv4len)
+		_, err := io.ReadFull(s, header)
+		if err != nil {
+			s.Reset()
+			return
+		}
+
+		port := binary.BigEndian.Uint16(header)
+		dst := net.IP(header[2:])
+
+		f.broadcastsMux.Lock()
+		r := f.broadcasts[port]
+		f.broadcastsMux.Unlock()
+
+		if r == nil || !f.isBroadcastPeer(r, s.Conn().RemotePeer()) {
+			s.Reset()
+			return
+		}
+
+		b, err := io.ReadAll(io.LimitReader(s, maxDatagramLen+1))
+		if err != nil || len(b) > maxDatagramLen {
+			s.Reset()
+			return
+		}
+
+		_, err = r.emit.WriteToUDP(b, &net.UDPAddr{
+			IP:   r.emitIP(dst),
+			Port: int(port),
+		})
+		if err != nil {
+			onErrFn(fmt.Errorf("broadcast: %s", err))
+		}
+	})
+}
+
+// emitIP returns address to re-emit datagram sent to `dst` at, it is the relayed
+// multicast group or the limited broadcast address. Broadcast address of the
+// peer's network means nothing here, and other groups are not emitted for peers
+func (r *broadcastRelay) emitIP(dst net.IP) net.IP {
+	if r.group != nil && (dst.Equal(r.group) || dst.IsUnspecified()) {
+		return r.group
+	}
+	return net.IPv4bcast
+}
@@ -2,20 +2,28 @@ package p2pforwarder
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/pnet"
 
 	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
 	routing2 "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
 	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
 
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -23,12 +31,17 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	"github.com/libp2p/go-libp2p/p2p/transport/quicreuse"
 	"github.com/sparkymat/appdir"
+	"go.uber.org/fx"
 )
 
 const (
 	protocolTypeTCP byte = 0x00
 	protocolTypeUDP byte = 0x01
+	// protocolTypeUnix ports forward connections to a unix socket of the serving side,
+	// they are listened on TCP or unix socket by the connecting side
+	protocolTypeUnix byte = 0x02
 )
 
 // Forwarder - instance of P2P Forwarder
@@ -36,44 +49,165 @@ type Forwarder struct {
 	host      host.Host
 	openPorts *openPortsStore
 
-	portsSubscriptions    map[peer.ID]chan *portsManifest
+	portsSubscriptions    map[peer.ID]*portsSubscription
 	portsSubscriptionsMux sync.Mutex
 
-	portsSubscribers    map[peer.ID]struct{}
+	// portsSubscribers holds lease expiration time of every subscriber
+	portsSubscribers    map[peer.ID]time.Time
 	portsSubscribersMux sync.Mutex
+
+	staticRelays []peer.AddrInfo
+
+	peerCache *peerCache
+
+	// udpTables are UDP session tables of opened and listened ports
+	udpTables    map[*udpSessionTable]struct{}
+	udpTablesMux sync.Mutex
+
+	// lanPeers are nodes found with mDNS
+	lanPeers    map[peer.ID]peer.AddrInfo
+	lanPeersMux sync.Mutex
+	mdns        mdns.Service
+
+	// broadcasts are broadcast relays of ports
+	broadcasts    map[uint16]*broadcastRelay
+	broadcastsMux sync.Mutex
+
+	// dgram is nil when QUIC transport is disabled
+	dgram *dgramChannel
+
+	// proxy is nil when proxy is not opened
+	proxy    *openProxy
+	proxyMux sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	dht    *dht.IpfsDHT
+
+	// closing is closed when Shutdown starts
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// pipes counts connections being piped, pipesMux guards adding to it
+	pipes    sync.WaitGroup
+	pipesMux sync.Mutex
 }
 
 type openPortsStore struct {
-	tcp *openPortsStoreMap
-	udp *openPortsStoreMap
+	tcp  *openPortsStoreMap
+	udp  *openPortsStoreMap
+	unix *openPortsStoreMap
 }
 
 type openPortsStoreMap struct {
-	ports map[uint16]context.Context
+	ports map[uint16]*openPort
 	mux   sync.Mutex
 }
 
+type openPort struct {
+	ctx context.Context
+
+	// allowedPeers is nil when every peer may dial the port
+	allowedPeers map[peer.ID]struct{}
+
+	// secret is nil when the port is not protected by a secret
+	secret []byte
+
+	// target is host:port to forward connections to, empty means the same port on this machine.
+	// It is socket path for unix ports
+	target string
+
+	// proxyProtocol is version of PROXY protocol header sent to the target, zero means none
+	proxyProtocol int
+
+	name        string
+	description string
+	proto       string
+
+	// udpSessions is nil for TCP ports
+	udpSessions *udpSessionTable
+}
+
+func (p *openPort) isAllowed(peerid peer.ID) bool {
+	if p.allowedPeers == nil {
+		return true
+	}
+
+	_, ok := p.allowedPeers[peerid]
+	return ok
+}
+
+func (p *openPort) targetAddr(port uint16) string {
+	if p.target == "" {
+		return ":" + strconv.Itoa(int(port))
+	}
+	return p.target
+}
+
 func newOpenPortsStore() *openPortsStore {
 	return &openPortsStore{
 		tcp: &openPortsStoreMap{
-			ports: map[uint16]context.Context{},
+			ports: map[uint16]*openPort{},
 		},
 		udp: &openPortsStoreMap{
-			ports: map[uint16]context.Context{},
+			ports: map[uint16]*openPort{},
+		},
+		unix: &openPortsStoreMap{
+			ports: map[uint16]*openPort{},
 		},
 	}
 }
 
-// NewForwarder - instances Forwarder and connects it to libp2p network
-func NewForwarder(p2p_port int) (*Forwarder, context.CancelFunc, error) {
+// Options - optional settings of Forwarder
+type Options struct {
+	// SwarmKey makes Forwarder join a private network of nodes sharing the same key
+	// instead of the public one. QUIC based transports and QUIC datagrams of UDP ports are disabled in this mode
+	SwarmKey pnet.PSK
+	// BootstrapPeers are used instead of the public bootstrap peers
+	BootstrapPeers []peer.AddrInfo
+	// StaticRelays are circuit relays to make reservations on when this node is behind NAT,
+	// so other nodes can reach it through them. They are also tried by Connect
+	StaticRelays []peer.AddrInfo
+	// RelayNode makes this node a relay for your other nodes: relay service starts
+	// without waiting for reachability detection. Use it on a node with public ip only
+	RelayNode bool
+	// RelayPeers are your nodes which RelayNode relays without time and data limits,
+	// other peers can not use it then. Empty relays every peer with the default limits
+	RelayPeers []peer.ID
+	// Offline keeps Forwarder off the public network when BootstrapPeers is empty: public
+	// bootstrap peers are not used and peers are found through the ones connected
+	// before, mDNS and multiaddrs passed to Connect
+	Offline bool
+	// DisableHolePunching turns off upgrading relayed connections to direct ones with DCUtR
+	DisableHolePunching bool
+	// DisableMDNS turns off discovery of p2ptunnel nodes on the local network
+	DisableMDNS bool
+}
+
+// NewForwarder - instances Forwarder and connects it to libp2p network, opts may be nil
+func NewForwarder(p2p_port int, opts *Options) (*Forwarder, context.CancelFunc, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	priv, err := loadUserPrivKey()
 	if err != nil {
 		return nil, nil, err
 	}
 
+	pcPath, err := peerCachePath()
+	if err != nil {
+		return nil, nil, err
+	}
+	pc, err := loadPeerCache(pcPath)
+	if err != nil {
+		onErrFn(fmt.Errorf("load peer cache: %s", err))
+		pc = &peerCache{path: pcPath}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
-	h, err := createLibp2pHost(ctx, priv, p2p_port)
+	h, d, qcm, err := createLibp2pHost(ctx, priv, p2p_port, opts, pc)
 	if err != nil {
 		cancel()
 		return nil, nil, err
@@ -83,17 +217,66 @@ func NewForwarder(p2p_port int) (*Forwarder, context.CancelFunc, error) {
 		fmt.Println("multiaddr:" + value.String())
 	}
 
+	pc.addToPeerstore(h.Peerstore())
+
 	f := &Forwarder{
 		host: h,
 
 		openPorts: newOpenPortsStore(),
 
-		portsSubscriptions: make(map[peer.ID]chan *portsManifest),
-		portsSubscribers:   make(map[peer.ID]struct{}),
+		portsSubscriptions: make(map[peer.ID]*portsSubscription),
+		portsSubscribers:   make(map[peer.ID]time.Time),
+
+		staticRelays: opts.StaticRelays,
+
+		peerCache: pc,
+
+		udpTables: make(map[*udpSessionTable]struct{}),
+
+		lanPeers: make(map[peer.ID]peer.AddrInfo),
+
+		broadcasts: make(map[uint16]*broadcastRelay),
+
+		ctx:    ctx,
+		cancel: cancel,
+		dht:    d,
+
+		closing: make(chan struct{}),
+	}
+
+	if qcm != nil {
+		f.dgram, err = newDgramChannel(ctx, h, qcm, priv)
+		if err != nil {
+			onErrFn(fmt.Errorf("quic datagrams: %s", err))
+		}
 	}
 
 	setDialHandler(f)
 	setPortsSubHandler(f)
+	setBroadcastHandler(f)
+	setProxyHandler(f)
+
+	go printRelayAddrs(ctx, h)
+
+	if !opts.DisableMDNS {
+		f.mdns, err = startMDNS(f)
+		if err != nil {
+			onErrFn(fmt.Errorf("mdns: %s", err))
+		}
+	}
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, c network.Conn) {
+			f.onPeerConnected(c)
+		},
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if n.Connectedness(c.RemotePeer()) == network.Connected {
+				return
+			}
+
+			f.onPeerDisconnected(c.RemotePeer())
+		},
+	})
 
 	return f, cancel, nil
 }
@@ -158,34 +341,116 @@ func loadUserPrivKey() (priv crypto.PrivKey, err error) {
 	return priv, nil
 }
 
+// LoadSwarmKey reads libp2p private network key (swarm.key) from file
+func LoadSwarmKey(path string) (pnet.PSK, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return pnet.DecodeV1PSK(f)
+}
+
 const Protocol = "/p2ptunnel/0.1"
 
-func createLibp2pHost(ctx context.Context, priv crypto.PrivKey, p2p_port int) (host.Host, error) {
-	var d *dht.IpfsDHT
+// bootstrapTimeout limits connecting to bootstrap peers on start
+const bootstrapTimeout = 10 * time.Second
+
+// ErrNoBootstrapPeers = error "None of bootstrap peers is reachable"
+var ErrNoBootstrapPeers = errors.New("None of bootstrap peers is reachable")
+
+// createLibp2pHost also returns QUIC connection manager of the host, it is nil when QUIC is disabled
+func createLibp2pHost(ctx context.Context, priv crypto.PrivKey, p2p_port int, opts *Options, pc *peerCache) (host.Host, *dht.IpfsDHT, *quicreuse.ConnManager, error) {
+	var (
+		d   *dht.IpfsDHT
+		qcm *quicreuse.ConnManager
+	)
 
 	connmgr, _ := connmgr.NewConnManager(
 		10,  // Lowwater
 		100, // HighWater,
 		connmgr.WithGracePeriod(time.Minute),
 	)
-	var h, err = libp2p.New(
-		libp2p.Identity(priv),
 
-		libp2p.ListenAddrStrings(
-			fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", p2p_port),
-			fmt.Sprintf("/ip6/::/tcp/%d", p2p_port),
+	listenAddrs := []string{
+		fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", p2p_port),
+		fmt.Sprintf("/ip6/::/tcp/%d", p2p_port),
+
+		fmt.Sprintf("/ip4/0.0.0.0/tcp/%d/ws", p2p_port),
+		fmt.Sprintf("/ip6/::/tcp/%d/ws", p2p_port),
+	}
+	transports := libp2p.DefaultTransports
 
-			fmt.Sprintf("/ip4/0.0.0.0/tcp/%d/ws", p2p_port),
-			fmt.Sprintf("/ip6/::/tcp/%d/ws", p2p_port),
+	bootstrapPeers := opts.BootstrapPeers
 
+	dhtOpts := []dht.Option{}
+
+	quicConnManager := libp2p.ChainOptions()
+
+	if opts.SwarmKey == nil {
+		listenAddrs = append(listenAddrs,
 			fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic-v1", p2p_port),
 			fmt.Sprintf("/ip6/::/udp/%d/quic-v1", p2p_port),
 
 			fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic-v1/webtransport", p2p_port),
 			fmt.Sprintf("/ip6/::/udp/%d/quic-v1/webtransport", p2p_port),
-		),
+		)
+
+		// QUIC datagrams of UDP ports share the socket of QUIC transport
+		quicConnManager = libp2p.WithFxOption(fx.Populate(&qcm))
+
+		if len(bootstrapPeers) == 0 && !opts.Offline {
+			bootstrapPeers = dht.GetDefaultBootstrapPeerAddrInfos()
+		}
+	} else {
+		// Private networks are not supported by QUIC based transports
+		transports = libp2p.ChainOptions(
+			libp2p.Transport(tcp.NewTCPTransport),
+			libp2p.Transport(websocket.New),
+		)
+
+		// Private network is usually too small for nodes to detect
+		// that they are reachable, so every node serves DHT records
+		dhtOpts = append(dhtOpts, dht.Mode(dht.ModeServer))
+	}
+
+	// Peers we connected to before are also used, so the DHT can be joined
+	// when the bootstrap peers are down or there are none
+	dhtOpts = append(dhtOpts, dht.BootstrapPeersFunc(func() []peer.AddrInfo {
+		return append(append([]peer.AddrInfo{}, bootstrapPeers...), pc.addrInfos()...)
+	}))
+
+	relayServiceOpts := []relay.Option{}
+	relayNode := libp2p.ChainOptions()
+	if opts.RelayNode {
+		if len(opts.RelayPeers) > 0 {
+			relayServiceOpts = append(relayServiceOpts,
+				relay.WithInfiniteLimits(),
+				relay.WithACL(newRelayPeersACL(opts.RelayPeers)),
+			)
+		}
+		relayNode = libp2p.ForceReachabilityPublic()
+	}
+
+	holePunching := libp2p.ChainOptions()
+	if !opts.DisableHolePunching {
+		holePunching = libp2p.EnableHolePunching()
+	}
+
+	autoRelay := libp2p.ChainOptions()
+	if len(opts.StaticRelays) > 0 {
+		autoRelay = libp2p.EnableAutoRelayWithStaticRelays(opts.StaticRelays)
+	}
+
+	var h, err = libp2p.New(
+		libp2p.Identity(priv),
+
+		libp2p.ListenAddrStrings(listenAddrs...),
+
+		transports,
 
-		libp2p.DefaultTransports,
+		libp2p.PrivateNetwork(opts.SwarmKey),
 
 		libp2p.Security(noise.ID, noise.New),
 		libp2p.Security(libp2ptls.ID, libp2ptls.New),
@@ -196,47 +461,47 @@ func createLibp2pHost(ctx context.Context, priv crypto.PrivKey, p2p_port int) (h
 		libp2p.ConnectionManager(connmgr),
 
 		libp2p.EnableRelay(),
-		libp2p.EnableRelayService(),
+		libp2p.EnableRelayService(relayServiceOpts...),
+		relayNode,
+		autoRelay,
+		holePunching,
+		quicConnManager,
 		libp2p.DefaultPeerstore,
 
 		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
 			var err error
-			d, err = dht.New(ctx, h, dht.BootstrapPeers(dht.GetDefaultBootstrapPeerAddrInfos()...))
+			d, err = dht.New(ctx, h, dhtOpts...)
 			return d, err
 		}),
 	)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	// This connects to public bootstrappers
-	for _, addr := range dht.DefaultBootstrapPeers {
-		pi, err := peer.AddrInfoFromP2pAddr(addr)
-		if err != nil {
-			panic(err)
-		}
-		h.Connect(ctx, *pi)
-	}
+	// This connects to bootstrappers
+	connectBootstrapPeers(ctx, h, append(bootstrapPeers, pc.addrInfos()...))
 
 	err = d.Bootstrap(ctx)
 	if err != nil {
-		return nil, err
+		h.Close()
+		return nil, nil, nil, err
 	}
 
 	d1 := routing2.NewRoutingDiscovery(d)
 
 	go func() {
-		_, err = d1.Advertise(ctx, Protocol)
+		_, err := d1.Advertise(ctx, Protocol)
 
 		if err != nil {
-			log.Println(err)
+			onErrFn(fmt.Errorf("advertise: %s", err))
 		}
 	}()
 
 	go func() {
 		peerChan, err := d1.FindPeers(ctx, Protocol)
 		if err != nil {
-			panic(err)
+			onErrFn(fmt.Errorf("find peers: %s", err))
+			return
 		}
 
 		for dhtPeer := range peerChan {
@@ -250,7 +515,64 @@ func createLibp2pHost(ctx context.Context, priv crypto.PrivKey, p2p_port int) (h
 		time.Sleep(time.Second * 10)
 	}()
 
-	return h, err
+	return h, d, qcm, err
+}
+
+// connectBootstrapPeers connects to `peers` at once and reports if none of them is reachable
+func connectBootstrapPeers(ctx context.Context, h host.Host, peers []peer.AddrInfo) {
+	if len(peers) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bootstrapTimeout)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		connected int32
+	)
+
+	for _, pi := range peers {
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+
+			if h.Connect(ctx, pi) == nil {
+				atomic.AddInt32(&connected, 1)
+			}
+		}(pi)
+	}
+
+	wg.Wait()
+
+	if connected == 0 {
+		onErrFn(fmt.Errorf("bootstrap: %s", ErrNoBootstrapPeers))
+	}
+}
+
+// printRelayAddrs prints addresses other nodes can reach this node at through relays
+func printRelayAddrs(ctx context.Context, h host.Host) {
+	sub, err := h.EventBus().Subscribe(new(event.EvtAutoRelayAddrsUpdated))
+	if err != nil {
+		onErrFn(fmt.Errorf("printRelayAddrs: %s", err))
+		return
+	}
+	defer sub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+
+			for _, addr := range e.(event.EvtAutoRelayAddrsUpdated).RelayAddrs {
+				onInfoFn("relay multiaddr:" + addr.String() + "/p2p/" + h.ID().String())
+			}
+		}
+	}
 }
 
 // ID returns id of Forwarder
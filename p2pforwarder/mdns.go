@@ -0,0 +1,73 @@
+package p2pforwarder
+
+import (
+	"context"
+	"sort"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+// mdnsServiceName differs from the libp2p default, so only p2ptunnel nodes find each other
+const mdnsServiceName = "_p2ptunnel._udp"
+
+// mdnsNotifee connects to p2ptunnel nodes found on the local network
+type mdnsNotifee struct {
+	f *Forwarder
+}
+
+func (n *mdnsNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	f := n.f
+
+	if pi.ID == f.host.ID() {
+		return
+	}
+
+	f.lanPeersMux.Lock()
+	_, known := f.lanPeers[pi.ID]
+	f.lanPeers[pi.ID] = pi
+	f.lanPeersMux.Unlock()
+
+	if !known {
+		onInfoFn("Found LAN peer " + pi.ID.String())
+	}
+
+	if f.host.Network().Connectedness(pi.ID) == network.Connected {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(f.ctx, connectTimeout)
+		defer cancel()
+
+		f.host.Connect(ctx, pi)
+	}()
+}
+
+func startMDNS(f *Forwarder) (mdns.Service, error) {
+	s := mdns.NewMdnsService(f.host, mdnsServiceName, &mdnsNotifee{f: f})
+
+	err := s.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// LANPeers returns p2ptunnel nodes found on the local network with mDNS
+func (f *Forwarder) LANPeers() []peer.AddrInfo {
+	f.lanPeersMux.Lock()
+	peers := make([]peer.AddrInfo, 0, len(f.lanPeers))
+	for _, pi := range f.lanPeers {
+		peers = append(peers, pi)
+	}
+	f.lanPeersMux.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+
+	return peers
+}
@@ -3,10 +3,16 @@ package p2pforwarder
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 var (
@@ -14,19 +20,108 @@ var (
 	ErrMaxConnections = errors.New("Max connections reached")
 	// ErrPortAlreadyOpened = error "Port already opened"
 	ErrPortAlreadyOpened = errors.New("Port already opened")
-	// ErrUnknownNetworkType = error "Unknown network type, it must be \"tcp\" or \"udp\""
-	ErrUnknownNetworkType = errors.New("Unknown network type, it must be \"tcp\" or \"udp\"")
+	// ErrUnknownNetworkType = error "Unknown network type, it must be \"tcp\", \"udp\" or \"unix\""
+	ErrUnknownNetworkType = errors.New("Unknown network type, it must be \"tcp\", \"udp\" or \"unix\"")
+	// ErrUnixTargetRequired = error "Unix socket port requires target socket path"
+	ErrUnixTargetRequired = errors.New("Unix socket port requires target socket path")
 	// ErrConnectionExists = error "You are already connected to specified host"
 	ErrConnectionExists = errors.New("You are already connected to specified host")
+	// ErrPeerNotAllowed = error "Peer is not allowed to dial this port"
+	ErrPeerNotAllowed = errors.New("Peer is not allowed to dial this port")
+	// ErrWrongSecret = error "Wrong secret"
+	ErrWrongSecret = errors.New("Wrong secret")
+	// ErrSecretRequired = error "Port requires a secret"
+	ErrSecretRequired = errors.New("Port requires a secret")
+	// ErrServiceInfoTooLong = error "Service name, description and protocol must be at most 255 bytes long"
+	ErrServiceInfoTooLong = errors.New("Service name, description and protocol must be at most 255 bytes long")
 )
 
-// OpenPort opens port in specified networkType - "tcp" or "udp"
-func (f *Forwarder) OpenPort(networkType string, port uint16) (cancel func(), err error) {
+// PortOptions - optional settings of an opened port
+type PortOptions struct {
+	// AllowedPeers are the only peers which may dial the port, empty means everyone
+	AllowedPeers []peer.ID
+	// Secret must be proven by dialing peers, empty means no secret
+	Secret string
+	// Target is host:port connections are forwarded to, empty means the opened port on this machine.
+	// It allows exposing services of other machines reachable from this one. For unix ports it is
+	// the socket path, e.g. "/var/run/docker.sock", and the port only identifies it for peers
+	Target string
+
+	// Name of the service, e.g. "office-rdp", it is shown to connecting peers
+	Name string
+	// Description of the service
+	Description string
+	// Proto is a hint of the application protocol, e.g. "rdp", "ssh" or "http"
+	Proto string
+
+	// ProxyProtocol is version of PROXY protocol header sent to the target before connection data,
+	// ProxyProtocolV1 or ProxyProtocolV2, zero sends none. It is not supported by udp ports
+	ProxyProtocol int
+
+	// UDPIdleTimeout closes UDP sessions with no datagrams for this time, zero means DefaultUDPIdleTimeout
+	UDPIdleTimeout time.Duration
+	// UDPMaxSessions limits number of UDP sessions of the port, zero means DefaultUDPMaxSessions
+	UDPMaxSessions int
+}
+
+// ConnectOptions - optional settings of a connection
+type ConnectOptions struct {
+	// Secret is used to dial remote ports protected by a secret
+	Secret string
+	// Services are names of remote services to listen for, empty means all ports
+	Services []string
+	// PortMap maps remote ports to local ports to listen on. Unmapped ports
+	// are listened on the same port number, or a random one when it is taken
+	PortMap map[uint16]uint16
+	// UnixSockets maps remote unix socket ports to local socket paths to listen on,
+	// unmapped ones are listened on TCP like tcp ports
+	UnixSockets map[uint16]string
+
+	// SOCKS5 is address to listen on for SOCKS5 clients, e.g. "127.0.0.1:1080", empty means none.
+	// Their connections are dialed by the peer if it opened proxy to the destination, see OpenProxy
+	SOCKS5 string
+
+	// UDPIdleTimeout closes UDP sessions with no datagrams for this time, zero means DefaultUDPIdleTimeout
+	UDPIdleTimeout time.Duration
+	// UDPMaxSessions limits number of UDP sessions of every remote port, zero means DefaultUDPMaxSessions
+	UDPMaxSessions int
+}
+
+func (opts *ConnectOptions) wantsService(name string) bool {
+	if len(opts.Services) == 0 {
+		return true
+	}
+
+	for _, s := range opts.Services {
+		if s == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (opts *ConnectOptions) secret() []byte {
+	if opts.Secret == "" {
+		return nil
+	}
+	return []byte(opts.Secret)
+}
+
+// OpenPort opens port in specified networkType - "tcp", "udp" or "unix", opts may be nil.
+// A unix port forwards connections to the socket at opts.Target
+func (f *Forwarder) OpenPort(networkType string, port uint16, opts *PortOptions) (cancel func(), err error) {
+	if opts == nil {
+		opts = &PortOptions{}
+	}
+
 	switch networkType {
 	case "tcp":
-		cancel, err = f.addOpenPort(f.openPorts.tcp, port)
+		cancel, err = f.addOpenPort(f.openPorts.tcp, port, opts)
 	case "udp":
-		cancel, err = f.addOpenPort(f.openPorts.udp, port)
+		cancel, err = f.addOpenPort(f.openPorts.udp, port, opts)
+	case "unix":
+		cancel, err = f.addOpenPort(f.openPorts.unix, port, opts)
 	default:
 		cancel, err = nil, ErrUnknownNetworkType
 		return
@@ -39,7 +134,32 @@ func (f *Forwarder) OpenPort(networkType string, port uint16) (cancel func(), er
 	return cancel, err
 }
 
-func (f *Forwarder) addOpenPort(portsMap *openPortsStoreMap, port uint16) (cancel func(), err error) {
+func (f *Forwarder) addOpenPort(portsMap *openPortsStoreMap, port uint16, opts *PortOptions) (cancel func(), err error) {
+	if len(opts.Name) > 255 || len(opts.Description) > 255 || len(opts.Proto) > 255 {
+		return nil, ErrServiceInfoTooLong
+	}
+
+	switch opts.ProxyProtocol {
+	case 0:
+	case ProxyProtocolV1, ProxyProtocolV2:
+		if portsMap == f.openPorts.udp {
+			return nil, ErrProxyProtocolUDP
+		}
+	default:
+		return nil, ErrUnknownProxyProtocol
+	}
+
+	if portsMap == f.openPorts.unix {
+		if opts.Target == "" {
+			return nil, ErrUnixTargetRequired
+		}
+	} else if opts.Target != "" {
+		_, _, err = net.SplitHostPort(opts.Target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %q: %s", opts.Target, err)
+		}
+	}
+
 	portsMap.mux.Lock()
 
 	if portsMap.ports[port] != nil {
@@ -47,8 +167,34 @@ func (f *Forwarder) addOpenPort(portsMap *openPortsStoreMap, port uint16) (cance
 		return nil, ErrPortAlreadyOpened
 	}
 
+	op := new(openPort)
+
+	if len(opts.AllowedPeers) > 0 {
+		op.allowedPeers = make(map[peer.ID]struct{}, len(opts.AllowedPeers))
+		for _, peerid := range opts.AllowedPeers {
+			op.allowedPeers[peerid] = struct{}{}
+		}
+	}
+
+	if opts.Secret != "" {
+		op.secret = []byte(opts.Secret)
+	}
+
+	op.target = opts.Target
+	op.proxyProtocol = opts.ProxyProtocol
+
+	op.name = opts.Name
+	op.description = opts.Description
+	op.proto = opts.Proto
+
 	var cancelfn func()
-	portsMap.ports[port], cancelfn = context.WithCancel(context.Background())
+	op.ctx, cancelfn = context.WithCancel(f.ctx)
+	portsMap.ports[port] = op
+
+	if portsMap == f.openPorts.udp {
+		op.udpSessions = newUDPSessionTable("", port, opts.UDPIdleTimeout, opts.UDPMaxSessions)
+		go f.runUDPSessionTable(op.ctx, op.udpSessions)
+	}
 
 	portsMap.mux.Unlock()
 
@@ -64,17 +210,59 @@ func (f *Forwarder) addOpenPort(portsMap *openPortsStoreMap, port uint16) (cance
 	return cancel, nil
 }
 
+// parseConnectTarget parses peer id or multiaddr ending with /p2p/ID
+func parseConnectTarget(id string) (*peer.AddrInfo, error) {
+	if !strings.HasPrefix(id, "/") {
+		peerid, err := peer.Decode(id)
+		if err != nil {
+			return nil, err
+		}
+		return &peer.AddrInfo{ID: peerid}, nil
+	}
+
+	addr, err := ma.NewMultiaddr(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return peer.AddrInfoFromP2pAddr(addr)
+}
+
 var (
 	listenIPks    = make([]bool, 255)
 	listenIPksMux sync.Mutex
 )
 
-// Connect starts forwarding connections to `listenip`:`PORT` to passed id`:`PORT`
-func (f *Forwarder) Connect(id string, ip string) (listenip string, cancel context.CancelFunc, err error) {
-	peerid, err := peer.Decode(id)
+// Connect starts forwarding connections to `listenip`:`PORT` to passed id`:`PORT`, opts may be nil.
+// `id` is either a peer id or a multiaddr ending with /p2p/ID, including relayed
+// /p2p-circuit ones, which is dialed without routing lookups. When the peer can not be
+// reached yet, the connection is kept and retried with backoff until cancel is called
+func (f *Forwarder) Connect(id string, ip string, opts *ConnectOptions) (listenip string, cancel context.CancelFunc, err error) {
+	if opts == nil {
+		opts = &ConnectOptions{}
+	}
+
+	pi, err := parseConnectTarget(id)
 	if err != nil {
 		return "", nil, err
 	}
+	peerid := pi.ID
+
+	// SOCKS5 address is taken first, so a busy one fails before anything is started
+	var socks5ln net.Listener
+	if opts.SOCKS5 != "" {
+		socks5ln, err = net.Listen("tcp", opts.SOCKS5)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	closeSOCKS5 := func() {
+		if socks5ln != nil {
+			socks5ln.Close()
+		}
+	}
+
+	f.host.Peerstore().AddAddrs(peerid, pi.Addrs, peerstore.PermanentAddrTTL)
 
 	// Getting free ip part
 	listenIPksMux.Lock()
@@ -90,6 +278,8 @@ func (f *Forwarder) Connect(id string, ip string) (listenip string, cancel conte
 		break
 	}
 	if lIPk == -1 {
+		listenIPksMux.Unlock()
+		closeSOCKS5()
 		return "", nil, ErrMaxConnections
 	}
 	listenip = "127.0.89." + strconv.Itoa(lIPk)
@@ -107,18 +297,24 @@ func (f *Forwarder) Connect(id string, ip string) (listenip string, cancel conte
 		listenIPks[lIPk] = false
 		listenIPksMux.Unlock()
 
+		closeSOCKS5()
 		return "", nil, ErrConnectionExists
 	}
-	subCh := make(chan *portsManifest, 5)
-	f.portsSubscriptions[peerid] = subCh
-	f.portsSubscriptionsMux.Unlock()
+	ctx, cancel := context.WithCancel(f.ctx)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	sub := &portsSubscription{
+		manifests:    make(chan *portsManifest, 5),
+		disconnected: make(chan struct{}, 1),
+		done:         ctx.Done(),
+	}
+	f.portsSubscriptions[peerid] = sub
+	f.portsSubscriptionsMux.Unlock()
 
 	go func() {
 		var (
-			tcpPortsOld = make(map[uint16]func())
-			udpPortsOld = make(map[uint16]func())
+			tcpPortsOld  = make(map[uint16]func())
+			udpPortsOld  = make(map[uint16]func())
+			unixPortsOld = make(map[uint16]func())
 		)
 
 	loop:
@@ -127,7 +323,6 @@ func (f *Forwarder) Connect(id string, ip string) (listenip string, cancel conte
 			case <-ctx.Done():
 				f.portsSubscriptionsMux.Lock()
 				delete(f.portsSubscriptions, peerid)
-				close(subCh)
 				f.portsSubscriptionsMux.Unlock()
 
 				listenIPksMux.Lock()
@@ -135,41 +330,34 @@ func (f *Forwarder) Connect(id string, ip string) (listenip string, cancel conte
 				listenIPksMux.Unlock()
 
 				break loop
-			case portsM := <-subCh:
-				if portsM.tcp != nil {
-					f.updatePortsListening(ctx, protocolTypeTCP, portsM.tcp, &tcpPortsOld, peerid, listenip)
-				}
-
-				if portsM.udp != nil {
-					f.updatePortsListening(ctx, protocolTypeUDP, portsM.udp, &udpPortsOld, peerid, listenip)
-				}
+			case portsM := <-sub.manifests:
+				f.updatePortsListening(ctx, protocolTypeTCP, portsM.tcp, &tcpPortsOld, peerid, listenip, opts)
+				f.updatePortsListening(ctx, protocolTypeUDP, portsM.udp, &udpPortsOld, peerid, listenip, opts)
+				f.updatePortsListening(ctx, protocolTypeUnix, portsM.unix, &unixPortsOld, peerid, listenip, opts)
 			}
 		}
 	}()
 
-	s, err := f.host.NewStream(ctx, peerid, portssubProtID)
-	if err != nil {
-		cancel()
-		return "", nil, err
-	}
+	// The peer is connected and subscribed to in the background, so a peer which is down does not hold the caller
+	go f.keepPortsSubscription(ctx, peerid, sub.disconnected, false)
 
-	// This starts subscription
-	_, err = s.Write([]byte{portssubModeSubscribe})
-	if err != nil {
-		s.Reset()
-		cancel()
-		return "", nil, err
+	if socks5ln != nil {
+		go f.serveSOCKS5(ctx, socks5ln, peerid, opts)
 	}
 
-	s.Close()
-
 	return listenip, cancel, nil
 }
 
-func (f *Forwarder) updatePortsListening(parentCtx context.Context, protocolType byte, portsArr []uint16, portsOld *map[uint16]func(), peerid peer.ID, listenip string) {
+func (f *Forwarder) updatePortsListening(parentCtx context.Context, protocolType byte, entries []portsManifestEntry, portsOld *map[uint16]func(), peerid peer.ID, listenip string, opts *ConnectOptions) {
 	ports := make(map[uint16]func())
 
-	for _, port := range portsArr {
+	for _, e := range entries {
+		if !opts.wantsService(e.name) {
+			continue
+		}
+
+		port := e.port
+
 		cancel, ok := (*portsOld)[port]
 
 		if ok {
@@ -181,7 +369,7 @@ func (f *Forwarder) updatePortsListening(parentCtx context.Context, protocolType
 		var ctx context.Context
 		ctx, ports[port] = context.WithCancel(parentCtx)
 
-		go f.dial(ctx, peerid, protocolType, listenip, port)
+		go f.dial(ctx, parentCtx, peerid, protocolType, listenip, e, opts)
 	}
 
 	for _, v := range *portsOld {
@@ -190,3 +378,77 @@ func (f *Forwarder) updatePortsListening(parentCtx context.Context, protocolType
 
 	*portsOld = ports
 }
+
+// Shutdown stops accepting connections, tells subscribers that all ports are
+// closed and waits for active connections to finish until `ctx` is done.
+// Then it closes all connections and libp2p host
+func (f *Forwarder) Shutdown(ctx context.Context) error {
+	f.closeOnce.Do(func() {
+		f.pipesMux.Lock()
+		close(f.closing)
+		f.pipesMux.Unlock()
+	})
+
+	f.publishOpenPortsManifestAndWait(ctx)
+
+	f.savePeerCache()
+
+	drained := make(chan struct{})
+	go func() {
+		f.pipes.Wait()
+		close(drained)
+	}()
+
+	var err error
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("shutdown: %s", ctx.Err())
+	}
+
+	f.cancel()
+
+	if f.mdns != nil {
+		f.mdns.Close()
+	}
+
+	if f.dgram != nil {
+		f.dgram.close()
+	}
+
+	if f.dht != nil {
+		f.dht.Close()
+	}
+
+	cerr := f.host.Close()
+	if err == nil && cerr != nil {
+		err = fmt.Errorf("shutdown: %s", cerr)
+	}
+
+	return err
+}
+
+func (f *Forwarder) isClosing() bool {
+	select {
+	case <-f.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// startPipe must be called before piping new connection and pipes.Done after it,
+// it returns false when Forwarder is shutting down
+func (f *Forwarder) startPipe() bool {
+	f.pipesMux.Lock()
+	defer f.pipesMux.Unlock()
+
+	if f.isClosing() {
+		return false
+	}
+
+	f.pipes.Add(1)
+
+	return true
+}
@@ -0,0 +1,215 @@
+package p2pforwarder
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/sparkymat/appdir"
+)
+
+// Addresses of peers we connected to are kept next to the keypair, so the
+// next run tries them before looking the peers up in the DHT. The file holds
+// one multiaddr ending with /p2p/ID per line.
+const (
+	// maxCachedPeers limits number of peers in the cache
+	maxCachedPeers = 64
+
+	// maxCachedAddrs limits number of addresses cached for a peer
+	maxCachedAddrs = 16
+)
+
+type peerCache struct {
+	path string
+
+	// peers are ordered from the least to the most recently connected
+	peers []peer.AddrInfo
+	mux   sync.Mutex
+}
+
+func peerCachePath() (string, error) {
+	return appdir.AppInfo{
+		Author: "nickname32",
+		Name:   "P2P Forwarder",
+	}.ConfigPath("peers")
+}
+
+// loadPeerCache reads cache from `path`, missing file gives an empty cache
+func loadPeerCache(path string) (*peerCache, error) {
+	pc := &peerCache{path: path}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return pc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	index := make(map[peer.ID]int)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		addr, err := ma.NewMultiaddr(line)
+		if err != nil {
+			continue
+		}
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			continue
+		}
+
+		i, ok := index[info.ID]
+		if !ok {
+			i = len(pc.peers)
+			index[info.ID] = i
+			pc.peers = append(pc.peers, peer.AddrInfo{ID: info.ID})
+		}
+		pc.peers[i].Addrs = append(pc.peers[i].Addrs, info.Addrs...)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+// addToPeerstore lets the host try cached addresses before routing lookups
+func (pc *peerCache) addToPeerstore(ps peerstore.Peerstore) {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+
+	for _, info := range pc.peers {
+		ps.AddAddrs(info.ID, info.Addrs, peerstore.AddressTTL)
+	}
+}
+
+// addrInfos returns copy of cached peers
+func (pc *peerCache) addrInfos() []peer.AddrInfo {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+
+	return append([]peer.AddrInfo{}, pc.peers...)
+}
+
+// update remembers `addrs` of `peerid` as the most recently connected peer
+func (pc *peerCache) update(peerid peer.ID, addrs []ma.Multiaddr) {
+	if len(addrs) == 0 {
+		return
+	}
+	if len(addrs) > maxCachedAddrs {
+		addrs = addrs[:maxCachedAddrs]
+	}
+
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+
+	for i, info := range pc.peers {
+		if info.ID == peerid {
+			pc.peers = append(pc.peers[:i], pc.peers[i+1:]...)
+			break
+		}
+	}
+
+	pc.peers = append(pc.peers, peer.AddrInfo{ID: peerid, Addrs: addrs})
+
+	if len(pc.peers) > maxCachedPeers {
+		pc.peers = pc.peers[len(pc.peers)-maxCachedPeers:]
+	}
+}
+
+// save writes cache to its file, it is replaced atomically
+func (pc *peerCache) save() error {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+
+	var sb strings.Builder
+	for _, info := range pc.peers {
+		addrs, err := peer.AddrInfoToP2pAddrs(&info)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			sb.WriteString(addr.String())
+			sb.WriteByte('\n')
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(pc.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := pc.path + ".tmp"
+
+	err = os.WriteFile(tmpPath, []byte(sb.String()), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, pc.path)
+}
+
+// rememberPeer caches addresses of connected `peerid` and saves the cache
+func (f *Forwarder) rememberPeer(peerid peer.ID) {
+	f.cachePeerAddrs(peerid)
+
+	err := f.peerCache.save()
+	if err != nil {
+		onErrFn(fmt.Errorf("save peer cache: %s", err))
+	}
+}
+
+// cachePeerAddrs puts addresses of open connections to `peerid` first,
+// followed by other addresses known from the peerstore
+func (f *Forwarder) cachePeerAddrs(peerid peer.ID) {
+	var addrs []ma.Multiaddr
+
+	seen := make(map[string]struct{})
+	add := func(addr ma.Multiaddr) {
+		if _, ok := seen[string(addr.Bytes())]; ok {
+			return
+		}
+		seen[string(addr.Bytes())] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+
+	for _, c := range f.host.Network().ConnsToPeer(peerid) {
+		add(c.RemoteMultiaddr())
+	}
+	for _, addr := range f.host.Peerstore().Addrs(peerid) {
+		add(addr)
+	}
+
+	f.peerCache.update(peerid, addrs)
+}
+
+// savePeerCache refreshes addresses of peers we are connected to and saves the cache
+func (f *Forwarder) savePeerCache() {
+	f.portsSubscriptionsMux.Lock()
+	for peerid := range f.portsSubscriptions {
+		if f.host.Network().Connectedness(peerid) == network.Connected {
+			f.cachePeerAddrs(peerid)
+		}
+	}
+	f.portsSubscriptionsMux.Unlock()
+
+	err := f.peerCache.save()
+	if err != nil {
+		onErrFn(fmt.Errorf("save peer cache: %s", err))
+	}
+}
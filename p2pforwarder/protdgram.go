@@ -0,0 +1,372 @@
+package p2pforwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	"github.com/libp2p/go-libp2p/p2p/transport/quicreuse"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/quic-go/quic-go"
+)
+
+// Datagrams of UDP sessions are sent as QUIC datagrams over a separate QUIC
+// connection between peers. It shares the UDP socket of the libp2p QUIC
+// transport and is authenticated with the libp2p TLS handshake. Lost
+// datagrams are not retransmitted and do not hold up the following ones as
+// they do on the dial stream, which stays as a fallback for datagrams too
+// large for QUIC and for peers the connection can not be made to.
+//
+// Every QUIC datagram starts with the direction byte and big-endian uint32
+// id of the session. The id is assigned by the side of the opened port and
+// sent over the dial stream, zero means QUIC datagrams are not supported.
+const dgramALPN = "/p2pforwarder/dgram/1.0.0"
+
+const (
+	dgramToOpenPort byte = 0x00
+	dgramToConnect  byte = 0x01
+)
+
+const dgramHeaderLen = 5
+
+// dgramDialTimeout limits establishing QUIC connection for datagrams
+const dgramDialTimeout = 10 * time.Second
+
+type dgramSessionKey struct {
+	peer      peer.ID
+	direction byte
+	id        uint32
+}
+
+type dgramSession struct {
+	sess *udpSession
+	// deliver writes datagram received from the peer to the local socket
+	deliver func(b []byte) error
+}
+
+// dgramChannel sends and receives datagrams of UDP sessions over QUIC connections to peers
+type dgramChannel struct {
+	ctx      context.Context
+	host     host.Host
+	cm       *quicreuse.ConnManager
+	identity *libp2ptls.Identity
+
+	listeners []quicreuse.Listener
+
+	conns    map[peer.ID]*dgramConn
+	dialing  map[peer.ID]struct{}
+	connsMux sync.Mutex
+
+	sessions    map[dgramSessionKey]*dgramSession
+	sessionsMux sync.Mutex
+
+	lastSessionID atomic.Uint32
+}
+
+type dgramConn struct {
+	conn *quic.Conn
+	// dialer is the peer which dialed the connection
+	dialer peer.ID
+}
+
+// newDgramChannel listens for QUIC connections for datagrams on QUIC addresses of `h`
+func newDgramChannel(ctx context.Context, h host.Host, cm *quicreuse.ConnManager, priv crypto.PrivKey) (*dgramChannel, error) {
+	identity, err := libp2ptls.NewIdentity(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &dgramChannel{
+		ctx:      ctx,
+		host:     h,
+		cm:       cm,
+		identity: identity,
+
+		conns:   make(map[peer.ID]*dgramConn),
+		dialing: make(map[peer.ID]struct{}),
+
+		sessions: make(map[dgramSessionKey]*dgramSession),
+	}
+
+	for _, addr := range h.Network().ListenAddresses() {
+		if !isQUICAddr(addr) {
+			continue
+		}
+
+		var tlsConf tls.Config
+		// Every handshake needs its own config verifying the peer certificate,
+		// the peer id is then taken from the certificate of the connection
+		tlsConf.GetConfigForClient = func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+			conf, _ := c.identity.ConfigForPeer("")
+			conf.NextProtos = []string{dgramALPN}
+			return conf, nil
+		}
+		tlsConf.NextProtos = []string{dgramALPN}
+
+		ln, err := cm.ListenQUIC(addr, &tlsConf, noWindowIncrease)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		c.listeners = append(c.listeners, ln)
+
+		go c.accept(ln)
+	}
+
+	return c, nil
+}
+
+// isQUICAddr reports whether `addr` is a plain quic-v1 address without webtransport or relay parts
+func isQUICAddr(addr ma.Multiaddr) bool {
+	ps := addr.Protocols()
+	return len(ps) == 3 &&
+		(ps[0].Code == ma.P_IP4 || ps[0].Code == ma.P_IP6) &&
+		ps[1].Code == ma.P_UDP &&
+		ps[2].Code == ma.P_QUIC_V1
+}
+
+// noWindowIncrease refuses flow control window increases, datagrams are not flow controlled
+func noWindowIncrease(conn *quic.Conn, delta uint64) bool {
+	return false
+}
+
+func (c *dgramChannel) accept(ln quicreuse.Listener) {
+	for {
+		conn, err := ln.Accept(c.ctx)
+		if err != nil {
+			return
+		}
+
+		pubKey, err := libp2ptls.PubKeyFromCertChain(conn.ConnectionState().TLS.PeerCertificates)
+		if err != nil {
+			conn.CloseWithError(0, "")
+			continue
+		}
+		peerid, err := peer.IDFromPublicKey(pubKey)
+		if err != nil {
+			conn.CloseWithError(0, "")
+			continue
+		}
+
+		c.addConn(peerid, conn, peerid)
+	}
+}
+
+// connect makes QUIC connection for datagrams to `peerid` unless there is one already.
+// Addresses of direct libp2p connections are tried first, as NAT has mappings for them
+func (c *dgramChannel) connect(peerid peer.ID) {
+	c.connsMux.Lock()
+	_, dialing := c.dialing[peerid]
+	if c.conns[peerid] != nil || dialing {
+		c.connsMux.Unlock()
+		return
+	}
+	c.dialing[peerid] = struct{}{}
+	c.connsMux.Unlock()
+
+	defer func() {
+		c.connsMux.Lock()
+		delete(c.dialing, peerid)
+		c.connsMux.Unlock()
+	}()
+
+	var addrs []ma.Multiaddr
+	for _, conn := range c.host.Network().ConnsToPeer(peerid) {
+		addrs = append(addrs, conn.RemoteMultiaddr())
+	}
+	addrs = append(addrs, c.host.Peerstore().Addrs(peerid)...)
+
+	ctx, cancel := context.WithTimeout(c.ctx, dgramDialTimeout)
+	defer cancel()
+
+	seen := make(map[string]struct{})
+	for _, addr := range addrs {
+		if !isQUICAddr(addr) {
+			continue
+		}
+		if _, ok := seen[string(addr.Bytes())]; ok {
+			continue
+		}
+		seen[string(addr.Bytes())] = struct{}{}
+
+		tlsConf, _ := c.identity.ConfigForPeer(peerid)
+		tlsConf.NextProtos = []string{dgramALPN}
+
+		conn, err := c.cm.DialQUIC(ctx, addr, tlsConf, noWindowIncrease)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		onInfoFn("QUIC datagrams to " + peerid.String() + " go over " + addr.String())
+
+		c.addConn(peerid, conn, c.host.ID())
+		return
+	}
+}
+
+// addConn makes `conn` dialed by `dialer` the connection to send datagrams to `peerid` with and receives datagrams from it.
+// It replaces the previous connection, but when both peers dialed at once and both connections are
+// live, the one dialed by the lower peer id is kept on both sides and the other is closed
+func (c *dgramChannel) addConn(peerid peer.ID, conn *quic.Conn, dialer peer.ID) {
+	c.connsMux.Lock()
+	old := c.conns[peerid]
+	if old != nil && old.conn.Context().Err() == nil && old.dialer < dialer {
+		c.connsMux.Unlock()
+
+		conn.CloseWithError(0, "")
+		return
+	}
+	c.conns[peerid] = &dgramConn{
+		conn:   conn,
+		dialer: dialer,
+	}
+	c.connsMux.Unlock()
+
+	if old != nil {
+		old.conn.CloseWithError(0, "")
+	}
+
+	go c.receive(peerid, conn)
+}
+
+func (c *dgramChannel) receive(peerid peer.ID, conn *quic.Conn) {
+	defer func() {
+		c.connsMux.Lock()
+		if dc := c.conns[peerid]; dc != nil && dc.conn == conn {
+			delete(c.conns, peerid)
+		}
+		c.connsMux.Unlock()
+
+		conn.CloseWithError(0, "")
+	}()
+
+	for {
+		b, err := conn.ReceiveDatagram(c.ctx)
+		if err != nil {
+			return
+		}
+		if len(b) < dgramHeaderLen {
+			continue
+		}
+
+		key := dgramSessionKey{
+			peer:      peerid,
+			direction: b[0],
+			id:        binary.BigEndian.Uint32(b[1:dgramHeaderLen]),
+		}
+
+		c.sessionsMux.Lock()
+		ds := c.sessions[key]
+		c.sessionsMux.Unlock()
+
+		if ds == nil {
+			continue
+		}
+
+		err = ds.deliver(b[dgramHeaderLen:])
+		if err != nil {
+			if ds.sess.ctx.Err() == nil {
+				onErrFn(fmt.Errorf("dgram: %s", err))
+			}
+			ds.sess.cancel()
+			continue
+		}
+		ds.sess.received(len(b) - dgramHeaderLen)
+		ds.sess.table.quicDatagramsReceived.Add(1)
+	}
+}
+
+// closeConn closes QUIC connection to `peerid`, if there is one
+func (c *dgramChannel) closeConn(peerid peer.ID) {
+	c.connsMux.Lock()
+	dc := c.conns[peerid]
+	c.connsMux.Unlock()
+
+	if dc != nil {
+		dc.conn.CloseWithError(0, "")
+	}
+}
+
+// newSessionID returns id for a session of an opened port, it is never zero
+func (c *dgramChannel) newSessionID() uint32 {
+	for {
+		id := c.lastSessionID.Add(1)
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+// addSession makes `sess` exchange datagrams with `peerid` over QUIC until it is closed.
+// `direction` is the one of datagrams received by this side
+func (c *dgramChannel) addSession(peerid peer.ID, direction byte, id uint32, sess *udpSession, deliver func(b []byte) error) {
+	key := dgramSessionKey{
+		peer:      peerid,
+		direction: direction,
+		id:        id,
+	}
+
+	c.sessionsMux.Lock()
+	c.sessions[key] = &dgramSession{
+		sess:    sess,
+		deliver: deliver,
+	}
+	c.sessionsMux.Unlock()
+
+	sendDirection := dgramToOpenPort
+	if direction == dgramToOpenPort {
+		sendDirection = dgramToConnect
+	}
+	sess.sendQUIC = func(b []byte) bool {
+		return c.send(peerid, sendDirection, id, b)
+	}
+
+	go func() {
+		<-sess.ctx.Done()
+
+		c.sessionsMux.Lock()
+		delete(c.sessions, key)
+		c.sessionsMux.Unlock()
+	}()
+}
+
+// send sends `b` to session `id` of `peerid`, it returns false when `b` must be sent over the dial stream
+func (c *dgramChannel) send(peerid peer.ID, direction byte, id uint32, b []byte) bool {
+	c.connsMux.Lock()
+	dc := c.conns[peerid]
+	c.connsMux.Unlock()
+
+	if dc == nil {
+		return false
+	}
+
+	frame := make([]byte, dgramHeaderLen+len(b))
+	frame[0] = direction
+	binary.BigEndian.PutUint32(frame[1:dgramHeaderLen], id)
+	copy(frame[dgramHeaderLen:], b)
+
+	return dc.conn.SendDatagram(frame) == nil
+}
+
+func (c *dgramChannel) close() {
+	for _, ln := range c.listeners {
+		ln.Close()
+	}
+
+	c.connsMux.Lock()
+	for _, dc := range c.conns {
+		dc.conn.CloseWithError(0, "")
+	}
+	c.connsMux.Unlock()
+}
@@ -2,30 +2,65 @@ package p2pforwarder
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	mrand "math/rand"
 	"net"
+	"os"
 	"strconv"
 	"sync"
+	"syscall"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
-	"github.com/pion/udp/v2"
 )
 
-const dialProtID protocol.ID = "/p2pforwarder/dial/1.0.0"
+const (
+	dialProtID protocol.ID = "/p2pforwarder/dial/2.1.0"
+	// dialProtIDStreamOnly is used by peers which send UDP datagrams over the dial stream only
+	dialProtIDStreamOnly protocol.ID = "/p2pforwarder/dial/2.0.0"
+)
+
+// After the auth exchange UDP datagrams are sent over the stream as
+// big-endian uint16 length followed by the datagram, so they are re-emitted
+// exactly as they were received. TCP is piped as a plain byte stream.
+const maxDatagramLen = 65535
+
+// With dialProtID the handler also sends big-endian uint32 id of the UDP
+// session for QUIC datagrams after the auth exchange, see dgramChannel
+const dgramSessionIDLen = 4
+
+// Right after the protocol/port header the handler tells the dialer whether
+// the port is protected by a secret. If it is, the handler sends a random
+// nonce and the dialer must answer with HMAC-SHA256 of the nonce, the header
+// and its own peer id keyed with the secret, so the secret is never sent.
+const (
+	dialAuthNone      byte = 0x00
+	dialAuthChallenge byte = 0x01
+)
+
+const dialAuthNonceLen = 32
 
 var dialsIP = "127.0.88.89"
 
 func setDialHandler(f *Forwarder) {
-	f.host.SetStreamHandler(dialProtID, func(s network.Stream) {
+	handler := func(s network.Stream) {
 		// String() is the stable textual representation for peer.ID in newer go-libp2p releases.
 		remotePeer := s.Conn().RemotePeer().String()
 		onInfoFn("'dial' from " + remotePeer)
 
+		if !f.startPipe() {
+			s.Reset()
+			return
+		}
+		defer f.pipes.Done()
+
 		portBytes := make([]byte, 3)
 		_, err := io.ReadFull(s, portBytes)
 		if err != nil {
@@ -53,42 +88,86 @@ func setDialHandler(f *Forwarder) {
 			addr = "udp:" + strconv.Itoa(portInt)
 
 			portsMap = f.openPorts.udp
+		case protocolTypeUnix:
+			addr = "unix:" + strconv.Itoa(portInt)
+
+			portsMap = f.openPorts.unix
 		default:
 			s.Reset()
 			return
 		}
 
-		onInfoFn("Dialing to " + addr + " from " + remotePeer)
+		onInfoFn("Dialing to " + addr + " from " + remotePeer + " through " + connKind(s.Conn()) + " connection")
 		defer onInfoFn("Closed dial to " + addr + " from " + remotePeer)
 
 		portsMap.mux.Lock()
-		portContext := portsMap.ports[port]
+		op := portsMap.ports[port]
 		portsMap.mux.Unlock()
 
-		if portContext == nil {
+		if op == nil {
+			s.Reset()
+			return
+		}
+
+		if !op.isAllowed(s.Conn().RemotePeer()) {
 			s.Reset()
+			onErrFn(fmt.Errorf("dial handler: %s: %s to %s", ErrPeerNotAllowed, remotePeer, addr))
 			return
 		}
 
+		err = checkDialChallenge(s, op.secret, portBytes)
+		if err != nil {
+			s.Reset()
+			onErrFn(fmt.Errorf("dial handler: %s: %s to %s", err, remotePeer, addr))
+			return
+		}
+
+		var sess *udpSession
+		if protocolType == protocolTypeUDP {
+			sess = op.udpSessions.add(op.ctx, s.ID())
+			if sess == nil {
+				s.Reset()
+				onErrFn(fmt.Errorf("dial handler: %s: %s to %s", ErrMaxUDPSessions, remotePeer, addr))
+				return
+			}
+			defer op.udpSessions.remove(sess)
+		}
+
 		var conn net.Conn
 
 		switch protocolType {
 		case protocolTypeTCP:
-			conn, err = net.DialTCP("tcp", &net.TCPAddr{
-				IP:   net.ParseIP(dialsIP),
-				Port: 0,
-			}, &net.TCPAddr{
-				IP:   nil,
-				Port: portInt,
-			})
+			var raddr *net.TCPAddr
+			raddr, err = net.ResolveTCPAddr("tcp", op.targetAddr(port))
+			if err == nil {
+				conn, err = net.DialTCP("tcp", &net.TCPAddr{
+					IP:   dialSourceIP(raddr.IP),
+					Port: 0,
+				}, raddr)
+			}
+			if err == nil && op.proxyProtocol != 0 {
+				err = writeProxyHeader(conn, op.proxyProtocol, s.Conn())
+				if err != nil {
+					conn.Close()
+				}
+			}
 		case protocolTypeUDP:
-			conn, err = net.DialUDP("udp", &net.UDPAddr{
-				IP:   net.ParseIP(dialsIP),
-				Port: 0,
-			}, &net.UDPAddr{
-				IP:   nil,
-				Port: portInt,
-			})
+			var raddr *net.UDPAddr
+			raddr, err = net.ResolveUDPAddr("udp", op.targetAddr(port))
+			if err == nil {
+				conn, err = net.DialUDP("udp", &net.UDPAddr{
+					IP:   dialSourceIP(raddr.IP),
+					Port: 0,
+				}, raddr)
+			}
+		case protocolTypeUnix:
+			conn, err = net.Dial("unix", op.target)
+			if err == nil && op.proxyProtocol != 0 {
+				err = writeProxyHeader(conn, op.proxyProtocol, s.Conn())
+				if err != nil {
+					conn.Close()
+				}
+			}
 		}
 
 		if err != nil {
@@ -97,36 +176,203 @@ func setDialHandler(f *Forwarder) {
 			return
 		}
 
-		pipeBothIOsAndClose(portContext, s, conn)
+		if sess != nil && s.Protocol() == dialProtID {
+			err = f.sendDgramSessionID(s, sess, conn)
+			if err != nil {
+				conn.Close()
+				s.Reset()
+				onErrFn(fmt.Errorf("dial handler: %s", err))
+				return
+			}
+		}
+
+		if sess != nil {
+			pipeDatagramsAndClose(sess, conn, s)
+		} else {
+			pipeBothIOsAndClose(op.ctx, s, conn)
+		}
+	}
+
+	f.host.SetStreamHandler(dialProtID, handler)
+	f.host.SetStreamHandler(dialProtIDStreamOnly, handler)
+}
+
+// sendDgramSessionID tells the dialer id of `sess` for QUIC datagrams, zero when they are disabled
+func (f *Forwarder) sendDgramSessionID(s network.Stream, sess *udpSession, conn net.Conn) error {
+	var id uint32
+	if f.dgram != nil {
+		id = f.dgram.newSessionID()
+		f.dgram.addSession(s.Conn().RemotePeer(), dgramToOpenPort, id, sess, func(b []byte) error {
+			_, err := conn.Write(b)
+			return err
+		})
+	}
+
+	b := make([]byte, dgramSessionIDLen)
+	binary.BigEndian.PutUint32(b, id)
+
+	_, err := s.Write(b)
+	return err
+}
+
+// receiveDgramSessionID reads id of `sess` for QUIC datagrams and starts using them when it is not zero
+func (f *Forwarder) receiveDgramSessionID(s network.Stream, sess *udpSession, ln *net.UDPConn, raddr *net.UDPAddr) error {
+	b := make([]byte, dgramSessionIDLen)
+	_, err := io.ReadFull(s, b)
+	if err != nil {
+		return err
+	}
+
+	id := binary.BigEndian.Uint32(b)
+	if id == 0 || f.dgram == nil {
+		return nil
+	}
+
+	peerid := s.Conn().RemotePeer()
+
+	f.dgram.addSession(peerid, dgramToConnect, id, sess, func(b []byte) error {
+		_, err := ln.WriteToUDP(b, raddr)
+		return err
 	})
+	go f.dgram.connect(peerid)
+
+	return nil
 }
 
-func createAddrInfoString(network string, listenip string, lport int, port int) string {
-	return network + " " + listenip + ":" + strconv.Itoa(lport) + " -> " + strconv.Itoa(port)
+// dialSourceIP returns local address to dial `ip` from. Connections to this
+// machine come from `dialsIP`, so they can be told apart from local ones
+func dialSourceIP(ip net.IP) net.IP {
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() && ip.To4() != nil {
+		return net.ParseIP(dialsIP)
+	}
+	return nil
 }
 
-func (f *Forwarder) dial(ctx context.Context, peerid peer.ID, protocolType byte, listenip string, port uint16) {
+func checkDialChallenge(s network.Stream, secret []byte, header []byte) error {
+	if secret == nil {
+		_, err := s.Write([]byte{dialAuthNone})
+		return err
+	}
+
+	b := make([]byte, 1+dialAuthNonceLen)
+	b[0] = dialAuthChallenge
+
+	_, err := rand.Read(b[1:])
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Write(b)
+	if err != nil {
+		return err
+	}
+
+	answer := make([]byte, sha256.Size)
+	_, err = io.ReadFull(s, answer)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(answer, dialChallengeMAC(secret, b[1:], header, s.Conn().RemotePeer())) {
+		return ErrWrongSecret
+	}
+
+	return nil
+}
+
+func answerDialChallenge(s network.Stream, secret []byte, header []byte, localPeer peer.ID) error {
+	mode := make([]byte, 1)
+	_, err := io.ReadFull(s, mode)
+	if err != nil {
+		return err
+	}
+
+	switch mode[0] {
+	case dialAuthNone:
+		return nil
+	case dialAuthChallenge:
+	default:
+		return fmt.Errorf("unknown auth mode %d", mode[0])
+	}
+
+	nonce := make([]byte, dialAuthNonceLen)
+	_, err = io.ReadFull(s, nonce)
+	if err != nil {
+		return err
+	}
+
+	if secret == nil {
+		return ErrSecretRequired
+	}
+
+	_, err = s.Write(dialChallengeMAC(secret, nonce, header, localPeer))
+	return err
+}
+
+func dialChallengeMAC(secret []byte, nonce []byte, header []byte, dialer peer.ID) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write(header)
+	mac.Write([]byte(dialer))
+	return mac.Sum(nil)
+}
+
+func createAddrInfoString(network string, laddr string, e portsManifestEntry) string {
+	str := network + " " + laddr + " -> " + strconv.Itoa(int(e.port))
+
+	if e.name != "" {
+		str += " " + e.name
+		if e.proto != "" {
+			str += " [" + e.proto + "]"
+		}
+	}
+	if e.description != "" {
+		str += " (" + e.description + ")"
+	}
+
+	return str
+}
+
+// dial listens for connections to remote port until `ctx` is done. Accepted
+// TCP connections are piped until `connCtx` of the whole connection is done, so
+// they are not broken when the port disappears from manifest
+func (f *Forwarder) dial(ctx context.Context, connCtx context.Context, peerid peer.ID, protocolType byte, listenip string, e portsManifestEntry, opts *ConnectOptions) {
+	port := e.port
+
+	if path, ok := opts.UnixSockets[port]; ok && protocolType == protocolTypeUnix {
+		f.dialUnixSocket(ctx, connCtx, peerid, path, e, opts)
+		return
+	}
+
 	lport := int(port)
 
-	var addressinfostr string
+	lportMapped, mapped := opts.PortMap[port]
+	if mapped {
+		lport = int(lportMapped)
+	}
+
+	var networkstr string
 
-	var listenfunc func(lip net.IP, port int) (net.Listener, error)
+	var listenfunc func(lip net.IP, port int) (io.Closer, error)
 
 	switch protocolType {
-	case protocolTypeTCP:
-		addressinfostr = createAddrInfoString("tcp", listenip, lport, int(port))
+	case protocolTypeTCP, protocolTypeUnix:
+		networkstr = "tcp"
+		if protocolType == protocolTypeUnix {
+			networkstr = "unix"
+		}
 
-		listenfunc = func(lip net.IP, port int) (net.Listener, error) {
+		listenfunc = func(lip net.IP, port int) (io.Closer, error) {
 			return net.ListenTCP("tcp", &net.TCPAddr{
 				IP:   lip,
 				Port: port,
 			})
 		}
 	case protocolTypeUDP:
-		addressinfostr = createAddrInfoString("udp", listenip, lport, int(port))
+		networkstr = "udp"
 
-		listenfunc = func(lip net.IP, port int) (net.Listener, error) {
-			return udp.Listen("udp", &net.UDPAddr{
+		listenfunc = func(lip net.IP, port int) (io.Closer, error) {
+			return net.ListenUDP("udp", &net.UDPAddr{
 				IP:   lip,
 				Port: port,
 			})
@@ -139,8 +385,13 @@ func (f *Forwarder) dial(ctx context.Context, peerid peer.ID, protocolType byte,
 	if err != nil {
 		onErrFn(fmt.Errorf("dial: %s", err))
 
+		// Mapped port is expected to be predictable, so it is not replaced with a random one
+		if mapped {
+			return
+		}
+
 		for i := 0; i < 4; i++ {
-			lport = rand.Intn(65535-1024) + 1024
+			lport = mrand.Intn(65535-1024) + 1024
 
 			ln, err = listenfunc(lip, lport)
 
@@ -156,55 +407,278 @@ func (f *Forwarder) dial(ctx context.Context, peerid peer.ID, protocolType byte,
 		}
 	}
 
+	addressinfostr := createAddrInfoString(networkstr, listenip+":"+strconv.Itoa(lport), e)
+
 	onInfoFn("Listening " + addressinfostr)
 
-	go func() {
-	loop:
-		for {
-			conn, err := ln.Accept()
+	switch ln := ln.(type) {
+	case *net.TCPListener:
+		go f.acceptConns(ctx, connCtx, ln, peerid, protocolType, port, opts)
+	case *net.UDPConn:
+		go f.serveUDP(ctx, ln, peerid, port, opts)
+	}
+
+	// Connections which are already accepted are not closed on shutdown, so they can finish
+	select {
+	case <-ctx.Done():
+	case <-f.closing:
+	}
+	ln.Close()
+
+	onInfoFn("Closed " + addressinfostr)
+}
+
+// openDialStream opens dial stream to `port` of `peerid` and passes the auth challenge
+func (f *Forwarder) openDialStream(ctx context.Context, peerid peer.ID, protocolType byte, port uint16, opts *ConnectOptions) (network.Stream, error) {
+	s, err := f.newStream(ctx, peerid, dialProtID, dialProtIDStreamOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	p := make([]byte, 3)
+	p[0] = protocolType
+	binary.BigEndian.PutUint16(p[1:3], port)
+
+	_, err = s.Write(p)
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+
+	err = answerDialChallenge(s, opts.secret(), p, f.host.ID())
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// dialUnixSocket listens for connections to remote unix socket port on local unix socket `path` until `ctx` is done
+func (f *Forwarder) dialUnixSocket(ctx context.Context, connCtx context.Context, peerid peer.ID, path string, e portsManifestEntry, opts *ConnectOptions) {
+	err := removeStaleSocket(path)
+	if err != nil {
+		onErrFn(fmt.Errorf("dial: %s", err))
+		return
+	}
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{
+		Name: path,
+		Net:  "unix",
+	})
+	if err != nil {
+		onErrFn(fmt.Errorf("dial: %s", err))
+		return
+	}
+
+	addressinfostr := createAddrInfoString("unix", path, e)
+
+	onInfoFn("Listening " + addressinfostr)
+
+	go f.acceptConns(ctx, connCtx, ln, peerid, protocolTypeUnix, e.port, opts)
+
+	select {
+	case <-ctx.Done():
+	case <-f.closing:
+	}
+	// Closing removes the socket file
+	ln.Close()
+
+	onInfoFn("Closed " + addressinfostr)
+}
+
+// removeStaleSocket removes socket file at `path` left by a killed process, as it makes listening
+// fail. Sockets somebody listens on and other files are not touched, listening reports them
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is used by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// acceptConns pipes connections accepted by `ln` to `port` of `peerid`
+func (f *Forwarder) acceptConns(ctx context.Context, connCtx context.Context, ln net.Listener, peerid peer.ID, protocolType byte, port uint16, opts *ConnectOptions) {
+	networkstr := ln.Addr().Network()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			onErrFn(fmt.Errorf("dial: %s", err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.closing:
+				return
+			default:
+				continue
+			}
+		}
+
+		if !f.startPipe() {
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer f.pipes.Done()
+
+			s, err := f.openDialStream(connCtx, peerid, protocolType, port, opts)
 			if err != nil {
+				conn.Close()
 				onErrFn(fmt.Errorf("dial: %s", err))
-				select {
-				case <-ctx.Done():
-					break loop
-				default:
-					continue loop
-				}
+				return
 			}
 
-			onInfoFn("Accepted " + ln.Addr().Network() + " connection from " + conn.RemoteAddr().String() + " on " + ln.Addr().String())
+			onInfoFn("Accepted " + networkstr + " connection from " + conn.RemoteAddr().String() + " on " + ln.Addr().String() + " through " + connKind(s.Conn()) + " connection")
+			defer onInfoFn("Closed " + networkstr + " connection from " + conn.RemoteAddr().String() + " on " + ln.Addr().String())
+
+			pipeBothIOsAndClose(connCtx, conn, s)
+		}()
+	}
+}
+
+// serveUDP tunnels datagrams received by `ln` to `port` of `peerid`, every
+// source address gets its own session and stream
+func (f *Forwarder) serveUDP(ctx context.Context, ln *net.UDPConn, peerid peer.ID, port uint16, opts *ConnectOptions) {
+	table := newUDPSessionTable(peerid, port, opts.UDPIdleTimeout, opts.UDPMaxSessions)
+	go f.runUDPSessionTable(ctx, table)
 
-			go func() {
-				defer onInfoFn("Closed " + ln.Addr().Network() + " connection from " + conn.RemoteAddr().String() + " on " + ln.Addr().String())
+	buf := make([]byte, maxDatagramLen)
+
+	for {
+		n, raddr, err := ln.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.closing:
+				return
+			default:
+				onErrFn(fmt.Errorf("dial: %s", err))
+				continue
+			}
+		}
 
-				s, err := f.host.NewStream(ctx, peerid, dialProtID)
+		sess := table.get(raddr.String())
+		if sess == nil {
+			sess = f.startUDPSession(ctx, table, ln, raddr, peerid, port, opts)
+			if sess == nil {
+				continue
+			}
+		}
+
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		sess.enqueue(b)
+	}
+}
+
+// startUDPSession starts session of datagrams from `raddr`, it returns nil when they must be dropped
+func (f *Forwarder) startUDPSession(ctx context.Context, table *udpSessionTable, ln *net.UDPConn, raddr *net.UDPAddr, peerid peer.ID, port uint16, opts *ConnectOptions) *udpSession {
+	if !f.startPipe() {
+		return nil
+	}
+
+	sess := table.add(ctx, raddr.String())
+	if sess == nil {
+		f.pipes.Done()
+		// Every datagram of the source is rejected, RejectedSessions counts them
+		if table.firstRejection(raddr.String()) {
+			onErrFn(fmt.Errorf("dial: %s: %s on %s", ErrMaxUDPSessions, raddr, ln.LocalAddr()))
+		}
+		return nil
+	}
+
+	go func() {
+		defer f.pipes.Done()
+
+		s, err := f.openDialStream(sess.ctx, peerid, protocolTypeUDP, port, opts)
+		if err == nil && s.Protocol() == dialProtID {
+			err = f.receiveDgramSessionID(s, sess, ln, raddr)
+			if err != nil {
+				s.Reset()
+			}
+		}
+		if err != nil {
+			// The session is kept for a while, so datagrams resent by the source do not open a stream each
+			table.fail(sess)
+			onErrFn(fmt.Errorf("dial: %s", err))
+			return
+		}
+		defer table.remove(sess)
+
+		onInfoFn("Accepted udp session from " + raddr.String() + " on " + ln.LocalAddr().String() + " through " + connKind(s.Conn()) + " connection")
+		defer onInfoFn("Closed udp session from " + raddr.String() + " on " + ln.LocalAddr().String())
+
+		go func() {
+			for {
+				select {
+				case <-sess.ctx.Done():
+					return
+				case b := <-sess.queue:
+					if sess.sendOverQUIC(b) {
+						continue
+					}
+
+					err := writeDatagram(s, b)
+					if err != nil {
+						if sess.ctx.Err() == nil {
+							onErrFn(fmt.Errorf("dial: %s", err))
+						}
+						sess.cancel()
+						return
+					}
+					sess.sent(len(b))
+				}
+			}
+		}()
+		go func() {
+			buf := make([]byte, maxDatagramLen)
+			for {
+				n, err := readDatagram(s, buf)
 				if err != nil {
-					conn.Close()
-					onErrFn(fmt.Errorf("dial: %s", err))
+					if err != io.EOF && sess.ctx.Err() == nil {
+						onErrFn(fmt.Errorf("dial: %s", err))
+					}
+					sess.cancel()
 					return
 				}
 
-				p := make([]byte, 3)
-				p[0] = protocolType
-				binary.BigEndian.PutUint16(p[1:3], port)
-
-				_, err = s.Write(p)
+				_, err = ln.WriteToUDP(buf[:n], raddr)
 				if err != nil {
-					s.Reset()
-					conn.Close()
-					onErrFn(fmt.Errorf("dial: %s", err))
+					if sess.ctx.Err() == nil {
+						onErrFn(fmt.Errorf("dial: %s", err))
+					}
+					sess.cancel()
 					return
 				}
+				sess.received(n)
+			}
+		}()
 
-				pipeBothIOsAndClose(ctx, conn, s)
-			}()
-		}
+		<-sess.ctx.Done()
+		s.Close()
 	}()
 
-	<-ctx.Done()
-	ln.Close()
+	return sess
+}
 
-	onInfoFn("Closed " + addressinfostr)
+// closeWrite tells the other side of `c` that nothing more will be written, if `c` supports it
+func closeWrite(c io.ReadWriteCloser) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
 }
 
 // pipeBothIOsAndClose pipes `a` and `b` in both directions and closes them in the end
@@ -226,7 +700,9 @@ func pipeBothIOsAndClose(parentctx context.Context, a io.ReadWriteCloser, b io.R
 		if err != nil {
 			onErrFn(fmt.Errorf("pipeBothIOsAndClose b<-a: %s", err))
 			cancel()
+			return
 		}
+		closeWrite(b)
 	}()
 	go func() {
 		_, err := io.Copy(a, b)
@@ -234,7 +710,9 @@ func pipeBothIOsAndClose(parentctx context.Context, a io.ReadWriteCloser, b io.R
 		if err != nil {
 			onErrFn(fmt.Errorf("pipeBothIOsAndClose a<-b: %s", err))
 			cancel()
+			return
 		}
+		closeWrite(a)
 	}()
 
 	<-ctx.Done()
@@ -242,3 +720,90 @@ func pipeBothIOsAndClose(parentctx context.Context, a io.ReadWriteCloser, b io.R
 	a.Close()
 	b.Close()
 }
+
+// writeDatagram writes length prefixed datagram `b` to `w` with a single write
+func writeDatagram(w io.Writer, b []byte) error {
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads length prefixed datagram from `r` into `buf` of maxDatagramLen bytes
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	_, err := io.ReadFull(r, buf[:2])
+	if err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(buf[:2]))
+
+	_, err = io.ReadFull(r, buf[:n])
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// pipeDatagramsAndClose pipes datagrams of `conn` framed over stream `s` in
+// both directions until `sess` is closed and closes them in the end
+func pipeDatagramsAndClose(sess *udpSession, conn net.Conn, s io.ReadWriteCloser) {
+	go func() {
+		buf := make([]byte, maxDatagramLen)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if sess.ctx.Err() == nil {
+					onErrFn(fmt.Errorf("pipeDatagramsAndClose s<-conn: %s", err))
+				}
+				sess.cancel()
+				return
+			}
+
+			if sess.sendOverQUIC(buf[:n]) {
+				continue
+			}
+
+			err = writeDatagram(s, buf[:n])
+			if err != nil {
+				if sess.ctx.Err() == nil {
+					onErrFn(fmt.Errorf("pipeDatagramsAndClose s<-conn: %s", err))
+				}
+				sess.cancel()
+				return
+			}
+			sess.sent(n)
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxDatagramLen)
+		for {
+			n, err := readDatagram(s, buf)
+			if err != nil {
+				if err != io.EOF && sess.ctx.Err() == nil {
+					onErrFn(fmt.Errorf("pipeDatagramsAndClose conn<-s: %s", err))
+				}
+				sess.cancel()
+				return
+			}
+
+			_, err = conn.Write(buf[:n])
+			if err != nil {
+				if sess.ctx.Err() == nil {
+					onErrFn(fmt.Errorf("pipeDatagramsAndClose conn<-s: %s", err))
+				}
+				sess.cancel()
+				return
+			}
+			sess.received(n)
+		}
+	}()
+
+	<-sess.ctx.Done()
+
+	conn.Close()
+	s.Close()
+}
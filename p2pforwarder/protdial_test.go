@@ -0,0 +1,307 @@
+package p2pforwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	tests := []struct {
+		name      string
+		datagrams [][]byte
+		want      []byte
+	}{
+		{
+			name:      "empty datagram",
+			datagrams: [][]byte{{}},
+			want:      []byte{0, 0},
+		},
+		{
+			name:      "boundaries are kept",
+			datagrams: [][]byte{[]byte("ping"), []byte("p")},
+			want:      []byte{0, 4, 'p', 'i', 'n', 'g', 0, 1, 'p'},
+		},
+		{
+			name:      "max length",
+			datagrams: [][]byte{bytes.Repeat([]byte{0xAB}, maxDatagramLen)},
+			want:      append([]byte{0xFF, 0xFF}, bytes.Repeat([]byte{0xAB}, maxDatagramLen)...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			for _, d := range tt.datagrams {
+				err := writeDatagram(&b, d)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !bytes.Equal(b.Bytes(), tt.want) {
+				t.Fatalf("wrote %x, want %x", b.Bytes(), tt.want)
+			}
+
+			buf := make([]byte, maxDatagramLen)
+			for _, d := range tt.datagrams {
+				n, err := readDatagram(&b, buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf[:n], d) {
+					t.Errorf("read %x, want %x", buf[:n], d)
+				}
+			}
+
+			_, err := readDatagram(&b, buf)
+			if err != io.EOF {
+				t.Errorf("read after last datagram: got %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestReadDatagramTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{name: "short length", b: []byte{0}},
+		{name: "short datagram", b: []byte{0, 4, 'p', 'i'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readDatagram(bytes.NewReader(tt.b), make([]byte, maxDatagramLen))
+			if err != io.ErrUnexpectedEOF {
+				t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+		})
+	}
+}
+
+func TestUDPSessionOfUnreachablePeer(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+
+	var (
+		dialErrs    int
+		dialErrsMux sync.Mutex
+	)
+	// onErrFn is not restored, goroutines of the forwarder may still call it after the test
+	onErrFn = func(err error) {
+		if strings.HasPrefix(err.Error(), "dial: ") {
+			dialErrsMux.Lock()
+			dialErrs++
+			dialErrsMux.Unlock()
+		}
+	}
+	countDialErrs := func() int {
+		dialErrsMux.Lock()
+		defer dialErrsMux.Unlock()
+		return dialErrs
+	}
+
+	f, cancel, err := NewForwarder(0, &Options{Offline: true, DisableMDNS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	// Nothing listens on the peer's address, so every stream fails right away
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerid, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.host.Peerstore().AddAddr(peerid, ma.StringCast("/ip4/127.0.0.1/tcp/1"), peerstore.PermanentAddrTTL)
+
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go f.serveUDP(ctx, ln, peerid, 27015, &ConnectOptions{})
+
+	client, err := net.DialUDP("udp", nil, ln.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); countDialErrs() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("stream to unreachable peer did not fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The client resends, the failed session drops the datagrams instead of opening streams
+	for i := 0; i < 5; i++ {
+		_, err = client.Write([]byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if n := countDialErrs(); n != 1 {
+		t.Errorf("opened %d streams, want 1", n)
+	}
+}
+
+// testDialStream is one end of net.Pipe, its connection has the peer of the other end
+type testDialStream struct {
+	network.Stream
+
+	pipe net.Conn
+	conn network.Conn
+}
+
+func (s *testDialStream) Read(b []byte) (int, error)  { return s.pipe.Read(b) }
+func (s *testDialStream) Write(b []byte) (int, error) { return s.pipe.Write(b) }
+func (s *testDialStream) Conn() network.Conn          { return s.conn }
+
+func TestDialChallenge(t *testing.T) {
+	dialer := peer.ID("dialer")
+	header := []byte{protocolTypeTCP, 0x0D, 0x3D}
+	secret := []byte("mypassword")
+
+	// answer answers the challenge with `secret` for `header` as `localPeer`
+	answer := func(secret []byte, header []byte, localPeer peer.ID) func(s network.Stream) error {
+		return func(s network.Stream) error {
+			return answerDialChallenge(s, secret, header, localPeer)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		secret       []byte
+		answer       func(s network.Stream) error
+		wantErr      error
+		wantCheckErr error
+	}{
+		{
+			name:   "no secret",
+			answer: answer(nil, header, dialer),
+		},
+		{
+			name:   "no secret answered with one",
+			answer: answer(secret, header, dialer),
+		},
+		{
+			name:   "correct secret",
+			secret: secret,
+			answer: answer(secret, header, dialer),
+		},
+		{
+			name:         "wrong secret",
+			secret:       secret,
+			answer:       answer([]byte("guess"), header, dialer),
+			wantCheckErr: ErrWrongSecret,
+		},
+		{
+			name:         "missing secret",
+			secret:       secret,
+			answer:       answer(nil, header, dialer),
+			wantErr:      ErrSecretRequired,
+			wantCheckErr: io.EOF,
+		},
+		{
+			name:         "other port",
+			secret:       secret,
+			answer:       answer(secret, []byte{protocolTypeTCP, 0x00, 0x16}, dialer),
+			wantCheckErr: ErrWrongSecret,
+		},
+		{
+			name:         "other dialer",
+			secret:       secret,
+			answer:       answer(secret, header, peer.ID("other")),
+			wantCheckErr: ErrWrongSecret,
+		},
+		{
+			name:   "replayed answer",
+			secret: secret,
+			answer: func(s network.Stream) error {
+				challenge := make([]byte, 1+dialAuthNonceLen)
+				_, err := io.ReadFull(s, challenge)
+				if err != nil {
+					return err
+				}
+
+				// Answer of an earlier challenge, it was valid for its nonce only
+				_, err = s.Write(dialChallengeMAC(secret, make([]byte, dialAuthNonceLen), header, dialer))
+				return err
+			},
+			wantCheckErr: ErrWrongSecret,
+		},
+		{
+			name:   "truncated answer",
+			secret: secret,
+			answer: func(s network.Stream) error {
+				challenge := make([]byte, 1+dialAuthNonceLen)
+				_, err := io.ReadFull(s, challenge)
+				if err != nil {
+					return err
+				}
+
+				mac := dialChallengeMAC(secret, challenge[1:], header, dialer)
+				_, err = s.Write(mac[:len(mac)/2])
+				return err
+			},
+			wantCheckErr: io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlerEnd, dialerEnd := net.Pipe()
+
+			answered := make(chan error, 1)
+			go func() {
+				err := tt.answer(&testDialStream{pipe: dialerEnd})
+				dialerEnd.Close()
+				answered <- err
+			}()
+
+			err := checkDialChallenge(&testDialStream{
+				pipe: handlerEnd,
+				conn: &testProxyConn{peer: dialer},
+			}, tt.secret, header)
+			handlerEnd.Close()
+
+			if err != tt.wantCheckErr {
+				t.Errorf("check: got error %v, want %v", err, tt.wantCheckErr)
+			}
+
+			err = <-answered
+			if err != tt.wantErr {
+				t.Errorf("answer: got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
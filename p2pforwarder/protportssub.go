@@ -1,29 +1,70 @@
 package p2pforwarder
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
-const portssubProtID protocol.ID = "/p2pforwarder/portssub/1.0.0"
+const portssubProtID protocol.ID = "/p2pforwarder/portssub/2.0.0"
 
 const (
 	portssubModeManifest  byte = 0x00
 	portssubModeSubscribe byte = 0x01
 )
 
+// portsManifestVersion is the first byte of manifest, it is followed by
+// uint16 number of entries. Every entry is protocol type byte, uint16 port
+// and service name, description and protocol hint as 1 byte length-prefixed strings
+const portsManifestVersion byte = 0x02
+
+const (
+	// portsSubLease is how long subscription is kept without being renewed
+	portsSubLease = 10 * time.Minute
+	// portsSubRenewInterval is how often subscriptions are renewed
+	portsSubRenewInterval = 3 * time.Minute
+
+	portsSubRetryMin = time.Second
+	portsSubRetryMax = time.Minute
+)
+
+type portsSubscription struct {
+	manifests chan *portsManifest
+
+	// disconnected receives a value when all connections to the peer are closed
+	disconnected chan struct{}
+
+	// done is closed when the connection is cancelled, manifests are not received anymore.
+	// manifests is never closed, as handlers may still send to it
+	done <-chan struct{}
+}
+
 type portsManifest struct {
-	tcp []uint16
-	udp []uint16
+	tcp  []portsManifestEntry
+	udp  []portsManifestEntry
+	unix []portsManifestEntry
+}
+
+type portsManifestEntry struct {
+	port uint16
+
+	name        string
+	description string
+	proto       string
 }
 
+// ErrUnsupportedManifestVersion = error "Unsupported ports manifest version"
+var ErrUnsupportedManifestVersion = errors.New("Unsupported ports manifest version")
+
 func setPortsSubHandler(f *Forwarder) {
 	f.host.SetStreamHandler(portssubProtID, func(s network.Stream) {
 		// String() is the stable textual representation for peer.ID in newer go-libp2p releases.
@@ -41,10 +82,10 @@ func setPortsSubHandler(f *Forwarder) {
 		switch modeBytes[0] {
 		case portssubModeManifest:
 			f.portsSubscriptionsMux.Lock()
-			subCh := f.portsSubscriptions[s.Conn().RemotePeer()]
+			sub := f.portsSubscriptions[s.Conn().RemotePeer()]
 			f.portsSubscriptionsMux.Unlock()
 
-			if subCh == nil {
+			if sub == nil {
 				return
 			}
 
@@ -61,14 +102,17 @@ func setPortsSubHandler(f *Forwarder) {
 				return
 			}
 
-			subCh <- portsM
+			select {
+			case sub.manifests <- portsM:
+			case <-sub.done:
+			}
 
 		case portssubModeSubscribe:
 			f.portsSubscribersMux.Lock()
-			f.portsSubscribers[s.Conn().RemotePeer()] = struct{}{}
+			f.portsSubscribers[s.Conn().RemotePeer()] = time.Now().Add(portsSubLease)
 			f.portsSubscribersMux.Unlock()
 
-			b := f.createOpenPortsManifestBytes()
+			b := f.createOpenPortsManifestBytes(s.Conn().RemotePeer())
 
 			f.sendPortsManifestToSubscriber(s.Conn().RemotePeer(), b)
 		}
@@ -78,46 +122,109 @@ func setPortsSubHandler(f *Forwarder) {
 }
 
 func (f *Forwarder) publishOpenPortsManifest() {
-	b := f.createOpenPortsManifestBytes()
+	f.publishOpenPortsManifestAndWait(nil)
+}
+
+// publishOpenPortsManifestAndWait waits for manifests to be sent until `ctx`
+// is done, it does not wait when `ctx` is nil
+func (f *Forwarder) publishOpenPortsManifestAndWait(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	now := time.Now()
 
 	f.portsSubscribersMux.Lock()
-	for peerid := range f.portsSubscribers {
-		go f.sendPortsManifestToSubscriber(peerid, b)
+	for peerid, expires := range f.portsSubscribers {
+		if now.After(expires) {
+			delete(f.portsSubscribers, peerid)
+			continue
+		}
+
+		b := f.createOpenPortsManifestBytes(peerid)
+
+		wg.Add(1)
+		go func(peerid peer.ID) {
+			f.sendPortsManifestToSubscriber(peerid, b)
+			wg.Done()
+		}(peerid)
 	}
 	f.portsSubscribersMux.Unlock()
-}
 
-func (f *Forwarder) createOpenPortsManifestBytes() []byte {
-	f.openPorts.tcp.mux.Lock()
-	f.openPorts.udp.mux.Lock()
+	if ctx == nil {
+		return
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(sent)
+	}()
 
-	lt := len(f.openPorts.tcp.ports)
-	lu := len(f.openPorts.udp.ports)
+	select {
+	case <-sent:
+	case <-ctx.Done():
+	}
+}
 
-	b := make([]byte, 2+lt*2+2+lu*2)
+// createOpenPortsManifestBytes creates manifest of ports which `peerid` is allowed to dial,
+// the manifest is empty when Forwarder is shutting down
+func (f *Forwarder) createOpenPortsManifestBytes(peerid peer.ID) []byte {
+	var tcpPorts, udpPorts, unixPorts []portsManifestEntry
 
-	var i int
+	if !f.isClosing() {
+		f.openPorts.tcp.mux.Lock()
+		f.openPorts.udp.mux.Lock()
+		f.openPorts.unix.mux.Lock()
 
-	binary.BigEndian.PutUint16(b[i:i+2], uint16(lt))
-	i += 2
+		tcpPorts = allowedPorts(f.openPorts.tcp, peerid)
+		udpPorts = allowedPorts(f.openPorts.udp, peerid)
+		unixPorts = allowedPorts(f.openPorts.unix, peerid)
 
-	for k := range f.openPorts.tcp.ports {
-		binary.BigEndian.PutUint16(b[i:i+2], k)
-		i += 2
+		f.openPorts.tcp.mux.Unlock()
+		f.openPorts.udp.mux.Unlock()
+		f.openPorts.unix.mux.Unlock()
 	}
 
-	binary.BigEndian.PutUint16(b[i:i+2], uint16(lu))
-	i += 2
+	var b bytes.Buffer
+
+	b.WriteByte(portsManifestVersion)
+	binary.Write(&b, binary.BigEndian, uint16(len(tcpPorts)+len(udpPorts)+len(unixPorts)))
+
+	writePortsManifestEntries(&b, protocolTypeTCP, tcpPorts)
+	writePortsManifestEntries(&b, protocolTypeUDP, udpPorts)
+	writePortsManifestEntries(&b, protocolTypeUnix, unixPorts)
+
+	return b.Bytes()
+}
+
+func writePortsManifestEntries(b *bytes.Buffer, protocolType byte, entries []portsManifestEntry) {
+	for _, e := range entries {
+		b.WriteByte(protocolType)
+		binary.Write(b, binary.BigEndian, e.port)
 
-	for k := range f.openPorts.udp.ports {
-		binary.BigEndian.PutUint16(b[i:i+2], k)
-		i += 2
+		for _, str := range []string{e.name, e.description, e.proto} {
+			b.WriteByte(byte(len(str)))
+			b.WriteString(str)
+		}
 	}
+}
 
-	f.openPorts.tcp.mux.Unlock()
-	f.openPorts.udp.mux.Unlock()
+// allowedPorts must be called with portsMap.mux locked
+func allowedPorts(portsMap *openPortsStoreMap, peerid peer.ID) []portsManifestEntry {
+	entries := make([]portsManifestEntry, 0, len(portsMap.ports))
+
+	for port, op := range portsMap.ports {
+		if op.isAllowed(peerid) {
+			entries = append(entries, portsManifestEntry{
+				port: port,
+
+				name:        op.name,
+				description: op.description,
+				proto:       op.proto,
+			})
+		}
+	}
 
-	return b
+	return entries
 }
 
 func (f *Forwarder) sendPortsManifestToSubscriber(peerid peer.ID, b []byte) {
@@ -128,16 +235,101 @@ func (f *Forwarder) sendPortsManifestToSubscriber(peerid peer.ID, b []byte) {
 
 	onErrFn(err)
 
+	// Subscriber is kept until its lease expires, so it survives transient
+	// failures and gets manifest again when it renews subscription
 	f.portsSubscribersMux.Lock()
-	delete(f.portsSubscribers, peerid)
+	if time.Now().After(f.portsSubscribers[peerid]) {
+		delete(f.portsSubscribers, peerid)
+	}
 	f.portsSubscribersMux.Unlock()
 }
 
+// subscribePorts subscribes to manifests of `peerid` open ports or renews the subscription
+func (f *Forwarder) subscribePorts(ctx context.Context, peerid peer.ID) error {
+	s, err := f.newStream(ctx, peerid, portssubProtID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Write([]byte{portssubModeSubscribe})
+	if err != nil {
+		s.Reset()
+		return err
+	}
+
+	return s.Close()
+}
+
+// keepPortsSubscription renews subscription to `peerid` before its lease
+// expires and resubscribes with backoff when the peer disconnects. When
+// `subscribed` is false, as on Connect, it subscribes right away
+func (f *Forwarder) keepPortsSubscription(ctx context.Context, peerid peer.ID, disconnected <-chan struct{}, subscribed bool) {
+	renew := time.NewTimer(portsSubRenewInterval)
+	defer renew.Stop()
+
+	for {
+		if subscribed {
+			select {
+			case <-ctx.Done():
+				return
+			case <-renew.C:
+			case <-disconnected:
+				onInfoFn("Disconnected from " + peerid.String() + ", resubscribing")
+			}
+		}
+		subscribed = true
+
+		retry := portsSubRetryMin
+
+		for {
+			path, err := f.connectPeer(ctx, peerid)
+			if err == nil {
+				err = f.subscribePorts(ctx, peerid)
+			}
+			if err == nil {
+				onInfoFn("Subscribed to " + peerid.String() + " ports, " + path)
+				break
+			}
+
+			onErrFn(fmt.Errorf("subscribe to %s: %s, retrying", peerid, err))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+
+			retry *= 2
+			if retry > portsSubRetryMax {
+				retry = portsSubRetryMax
+			}
+		}
+
+		renew.Reset(portsSubRenewInterval)
+	}
+}
+
+func (f *Forwarder) onPeerDisconnected(peerid peer.ID) {
+	if f.dgram != nil {
+		f.dgram.closeConn(peerid)
+	}
+
+	f.portsSubscriptionsMux.Lock()
+	sub := f.portsSubscriptions[peerid]
+	if sub != nil {
+		select {
+		case sub.disconnected <- struct{}{}:
+		default:
+		}
+	}
+	f.portsSubscriptionsMux.Unlock()
+}
+
 // ErrConnReset = error Connection reset
 var ErrConnReset = errors.New("Connection reset")
 
 func (f *Forwarder) sendOpenPortsManifestBytes(peerid peer.ID, b []byte) error {
-	s, err := f.host.NewStream(context.Background(), peerid, portssubProtID)
+	s, err := f.newStream(context.Background(), peerid, portssubProtID)
 	if err != nil {
 		return fmt.Errorf("sendOpenPortsManifestBytes: %s", err)
 	}
@@ -171,40 +363,64 @@ func (f *Forwarder) sendOpenPortsManifestBytes(peerid peer.ID, b []byte) error {
 }
 
 func readPortsManifest(r io.Reader) (portsM *portsManifest, err error) {
-	portsM = new(portsManifest)
-
-	portsM.tcp, err = readPortsInManifest(r)
-	if err != nil {
-		return
-	}
-	portsM.udp, err = readPortsInManifest(r)
+	header := make([]byte, 3)
+	_, err = io.ReadFull(r, header)
 	if err != nil {
-		return
+		return nil, fmt.Errorf("readPortsManifest: %s", err)
 	}
 
-	return
-}
-
-func readPortsInManifest(r io.Reader) (ports []uint16, err error) {
-	portsNumBytes := make([]byte, 2)
-	_, err = io.ReadFull(r, portsNumBytes)
-	if err != nil {
-		return nil, err
+	if header[0] != portsManifestVersion {
+		return nil, fmt.Errorf("readPortsManifest: %s %d", ErrUnsupportedManifestVersion, header[0])
 	}
 
-	portsNum := int(binary.BigEndian.Uint16(portsNumBytes))
+	entriesNum := int(binary.BigEndian.Uint16(header[1:]))
 
-	ports = make([]uint16, portsNum)
+	portsM = new(portsManifest)
 
-	for i := 0; i < portsNum; i++ {
-		portBytes := make([]byte, 2)
-		_, err = io.ReadFull(r, portBytes)
+	for i := 0; i < entriesNum; i++ {
+		entryBytes := make([]byte, 3)
+		_, err = io.ReadFull(r, entryBytes)
 		if err != nil {
 			return nil, fmt.Errorf("readPortsManifest: %s", err)
 		}
 
-		ports[i] = binary.BigEndian.Uint16(portBytes)
+		e := portsManifestEntry{
+			port: binary.BigEndian.Uint16(entryBytes[1:]),
+		}
+
+		for _, str := range []*string{&e.name, &e.description, &e.proto} {
+			*str, err = readPortsManifestString(r)
+			if err != nil {
+				return nil, fmt.Errorf("readPortsManifest: %s", err)
+			}
+		}
+
+		// Entries of unknown protocol types are skipped
+		switch entryBytes[0] {
+		case protocolTypeTCP:
+			portsM.tcp = append(portsM.tcp, e)
+		case protocolTypeUDP:
+			portsM.udp = append(portsM.udp, e)
+		case protocolTypeUnix:
+			portsM.unix = append(portsM.unix, e)
+		}
+	}
+
+	return portsM, nil
+}
+
+func readPortsManifestString(r io.Reader) (string, error) {
+	lenBytes := make([]byte, 1)
+	_, err := io.ReadFull(r, lenBytes)
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, lenBytes[0])
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return "", err
 	}
 
-	return ports, nil
+	return string(b), nil
 }
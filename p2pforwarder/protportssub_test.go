@@ -0,0 +1,134 @@
+package p2pforwarder
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestOpenPortsManifestRoundTrip(t *testing.T) {
+	allowed := peer.ID("allowed")
+	other := peer.ID("other")
+
+	f := &Forwarder{
+		openPorts: &openPortsStore{
+			tcp: &openPortsStoreMap{ports: map[uint16]*openPort{
+				3389: {name: "office-rdp", description: "Office desktop", proto: "rdp"},
+				22:   {name: "ssh", allowedPeers: map[peer.ID]struct{}{allowed: {}}},
+			}},
+			udp: &openPortsStoreMap{ports: map[uint16]*openPort{
+				27015: {name: "game"},
+			}},
+			unix: &openPortsStoreMap{ports: map[uint16]*openPort{
+				2375: {description: "docker"},
+			}},
+		},
+		closing: make(chan struct{}),
+	}
+
+	tests := []struct {
+		name   string
+		peerid peer.ID
+		want   *portsManifest
+	}{
+		{
+			name:   "every port",
+			peerid: allowed,
+			want: &portsManifest{
+				tcp: []portsManifestEntry{
+					{port: 22, name: "ssh"},
+					{port: 3389, name: "office-rdp", description: "Office desktop", proto: "rdp"},
+				},
+				udp:  []portsManifestEntry{{port: 27015, name: "game"}},
+				unix: []portsManifestEntry{{port: 2375, description: "docker"}},
+			},
+		},
+		{
+			name:   "only allowed ports",
+			peerid: other,
+			want: &portsManifest{
+				tcp:  []portsManifestEntry{{port: 3389, name: "office-rdp", description: "Office desktop", proto: "rdp"}},
+				udp:  []portsManifestEntry{{port: 27015, name: "game"}},
+				unix: []portsManifestEntry{{port: 2375, description: "docker"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readPortsManifest(bytes.NewReader(f.createOpenPortsManifestBytes(tt.peerid)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Ports of the same type are written in map order
+			if len(got.tcp) == 2 && got.tcp[0].port > got.tcp[1].port {
+				got.tcp[0], got.tcp[1] = got.tcp[1], got.tcp[0]
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPortsManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		want    *portsManifest
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			b:    []byte{portsManifestVersion, 0, 0},
+			want: &portsManifest{},
+		},
+		{
+			name: "unknown type is skipped",
+			b: []byte{
+				portsManifestVersion, 0, 2,
+				0x7F, 0x1F, 0x90, 1, 'x', 0, 0,
+				protocolTypeTCP, 0x00, 0x16, 3, 's', 's', 'h', 0, 0,
+			},
+			want: &portsManifest{tcp: []portsManifestEntry{{port: 22, name: "ssh"}}},
+		},
+		{
+			name:    "old version",
+			b:       []byte{0x01, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "missing entry",
+			b:       []byte{portsManifestVersion, 0, 1},
+			wantErr: true,
+		},
+		{
+			name:    "truncated string",
+			b:       []byte{portsManifestVersion, 0, 1, protocolTypeUDP, 0x69, 0x87, 5, 'g', 'a'},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readPortsManifest(bytes.NewReader(tt.b))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package p2pforwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Proxy dial lets peers reach destinations of this machine's network which
+// are not opened as ports, e.g. through their local SOCKS5 server. The dialer
+// sends destination host as 1 byte length-prefixed string and big-endian
+// uint16 port, then passes the same auth challenge as dial with them as header.
+// The handler resolves the host on its network, dials it when it is allowed
+// and answers with SOCKS5 reply code. Connection data follows a successful one.
+const proxyProtID protocol.ID = "/p2pforwarder/proxy/1.0.0"
+
+// proxyDialTimeout limits dialing a destination by the proxy handler
+const proxyDialTimeout = 10 * time.Second
+
+var (
+	// ErrProxyAlreadyOpened = error "Proxy is already opened"
+	ErrProxyAlreadyOpened = errors.New("Proxy is already opened")
+	// ErrNoProxyDestinations = error "Proxy requires allowed destinations"
+	ErrNoProxyDestinations = errors.New("Proxy requires allowed destinations")
+	// ErrDestinationNotAllowed = error "Destination is not allowed"
+	ErrDestinationNotAllowed = errors.New("Destination is not allowed")
+	// ErrProxyNotProtected = error "Proxy requires allowed peers or a secret"
+	ErrProxyNotProtected = errors.New("Proxy requires allowed peers or a secret")
+)
+
+// ProxyOptions - settings of OpenProxy
+type ProxyOptions struct {
+	// Destinations peers may reach as "CIDR" or "CIDR:PORTS", where PORTS is a port or a range,
+	// e.g. "192.168.1.0/24", "10.0.0.0/8:8000-8100". A single IP is its /32 or /128 network,
+	// e.g. "192.168.1.20:3389" or "[fd00::1]:22"
+	Destinations []string
+
+	// AllowedPeers may use the proxy, empty allows every peer which proves Secret.
+	// Either of them must be set, as the proxy reaches into this machine's network
+	AllowedPeers []peer.ID
+	// Secret must be proven by dialing peers, empty means no secret
+	Secret string
+}
+
+type openProxy struct {
+	ctx context.Context
+
+	// allowedPeers is nil when every peer may use the proxy
+	allowedPeers map[peer.ID]struct{}
+
+	// secret is nil when the proxy is not protected by a secret
+	secret []byte
+
+	destinations []proxyDestination
+}
+
+type proxyDestination struct {
+	ipnet *net.IPNet
+
+	portMin uint16
+	portMax uint16
+}
+
+// OpenProxy lets peers dial allowed destinations of this machine's network
+// through their SOCKS5 server, see ConnectOptions.SOCKS5
+func (f *Forwarder) OpenProxy(opts *ProxyOptions) (cancel func(), err error) {
+	if opts == nil || len(opts.Destinations) == 0 {
+		return nil, ErrNoProxyDestinations
+	}
+	if len(opts.AllowedPeers) == 0 && opts.Secret == "" {
+		return nil, ErrProxyNotProtected
+	}
+
+	p := new(openProxy)
+
+	for _, str := range opts.Destinations {
+		d, err := parseProxyDestination(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy destination %q: %s", str, err)
+		}
+		p.destinations = append(p.destinations, d)
+	}
+
+	if len(opts.AllowedPeers) > 0 {
+		p.allowedPeers = make(map[peer.ID]struct{}, len(opts.AllowedPeers))
+		for _, peerid := range opts.AllowedPeers {
+			p.allowedPeers[peerid] = struct{}{}
+		}
+	}
+
+	if opts.Secret != "" {
+		p.secret = []byte(opts.Secret)
+	}
+
+	f.proxyMux.Lock()
+	defer f.proxyMux.Unlock()
+
+	if f.proxy != nil {
+		return nil, ErrProxyAlreadyOpened
+	}
+
+	var cancelfn func()
+	p.ctx, cancelfn = context.WithCancel(f.ctx)
+	f.proxy = p
+
+	onInfoFn("Proxy opened to " + strings.Join(opts.Destinations, ","))
+
+	cancel = func() {
+		f.proxyMux.Lock()
+		cancelfn()
+		if f.proxy == p {
+			f.proxy = nil
+		}
+		f.proxyMux.Unlock()
+	}
+
+	return cancel, nil
+}
+
+// parseProxyDestination parses destination of ProxyOptions.Destinations
+func parseProxyDestination(s string) (proxyDestination, error) {
+	d := proxyDestination{
+		portMin: 0,
+		portMax: 65535,
+	}
+
+	addr, ports := s, ""
+	if i := strings.LastIndexByte(s, '/'); i >= 0 {
+		// Ports follow prefix length of CIDR
+		if j := strings.IndexByte(s[i:], ':'); j >= 0 {
+			addr, ports = s[:i+j], s[i+j+1:]
+		}
+	} else if host, port, err := net.SplitHostPort(s); err == nil {
+		addr, ports = host, port
+	}
+
+	if strings.Contains(addr, "/") {
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return d, err
+		}
+		d.ipnet = ipnet
+	} else {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return d, errors.New("invalid IP address")
+		}
+
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		d.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+
+	if ports != "" {
+		from, to, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			to = from
+		}
+
+		portMin, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return d, err
+		}
+		portMax, err := strconv.ParseUint(to, 10, 16)
+		if err != nil {
+			return d, err
+		}
+		if portMin > portMax {
+			return d, errors.New("invalid port range")
+		}
+
+		d.portMin, d.portMax = uint16(portMin), uint16(portMax)
+	}
+
+	return d, nil
+}
+
+func (p *openProxy) isAllowed(peerid peer.ID) bool {
+	if p.allowedPeers == nil {
+		return true
+	}
+
+	_, ok := p.allowedPeers[peerid]
+	return ok
+}
+
+func (p *openProxy) isDestinationAllowed(ip net.IP, port uint16) bool {
+	for _, d := range p.destinations {
+		if d.ipnet.Contains(ip) && port >= d.portMin && port <= d.portMax {
+			return true
+		}
+	}
+	return false
+}
+
+// dial dials `host`:`port` on the first allowed address, it returns SOCKS5 reply code
+func (p *openProxy) dial(host string, port uint16) (net.Conn, byte, error) {
+	ctx, cancel := context.WithTimeout(p.ctx, proxyDialTimeout)
+	defer cancel()
+
+	ipaddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, socks5HostUnreachable, err
+	}
+
+	// Resolved addresses are checked and dialed, so names can not lead to disallowed ones
+	var ips []net.IP
+	for _, ipaddr := range ipaddrs {
+		if p.isDestinationAllowed(ipaddr.IP, port) {
+			ips = append(ips, ipaddr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, socks5NotAllowed, ErrDestinationNotAllowed
+	}
+
+	for _, ip := range ips {
+		d := net.Dialer{
+			LocalAddr: &net.TCPAddr{
+				IP:   dialSourceIP(ip),
+				Port: 0,
+			},
+		}
+
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+		if err == nil {
+			return conn, socks5Succeeded, nil
+		}
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return nil, socks5ConnectionRefused, err
+	case errors.Is(err, syscall.ENETUNREACH):
+		return nil, socks5NetworkUnreachable, err
+	}
+	return nil, socks5HostUnreachable, err
+}
+
+func setProxyHandler(f *Forwarder) {
+	f.host.SetStreamHandler(proxyProtID, func(s network.Stream) {
+		// String() is the stable textual representation for peer.ID in newer go-libp2p releases.
+		remotePeer := s.Conn().RemotePeer().String()
+		onInfoFn("'proxy' from " + remotePeer)
+
+		if !f.startPipe() {
+			s.Reset()
+			return
+		}
+		defer f.pipes.Done()
+
+		header, host, port, err := readProxyRequest(s)
+		if err != nil {
+			s.Reset()
+			onErrFn(fmt.Errorf("proxy handler: %s", err))
+			return
+		}
+
+		addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+		f.proxyMux.Lock()
+		p := f.proxy
+		f.proxyMux.Unlock()
+
+		if p == nil {
+			s.Reset()
+			return
+		}
+
+		if !p.isAllowed(s.Conn().RemotePeer()) {
+			s.Reset()
+			onErrFn(fmt.Errorf("proxy handler: %s: %s to %s", ErrPeerNotAllowed, remotePeer, addr))
+			return
+		}
+
+		err = checkDialChallenge(s, p.secret, header)
+		if err != nil {
+			s.Reset()
+			onErrFn(fmt.Errorf("proxy handler: %s: %s to %s", err, remotePeer, addr))
+			return
+		}
+
+		conn, reply, err := p.dial(host, port)
+
+		_, werr := s.Write([]byte{reply})
+		if err != nil {
+			s.Close()
+			onErrFn(fmt.Errorf("proxy handler: %s: %s to %s", err, remotePeer, addr))
+			return
+		}
+		if werr != nil {
+			conn.Close()
+			s.Reset()
+			onErrFn(fmt.Errorf("proxy handler: %s", werr))
+			return
+		}
+
+		onInfoFn("Proxying to " + addr + " from " + remotePeer + " through " + connKind(s.Conn()) + " connection")
+		defer onInfoFn("Closed proxy to " + addr + " from " + remotePeer)
+
+		pipeBothIOsAndClose(p.ctx, s, conn)
+	})
+}
+
+// readProxyRequest reads destination of proxy dial, `header` is the raw request for the auth challenge
+func readProxyRequest(r io.Reader) (header []byte, host string, port uint16, err error) {
+	lenBytes := make([]byte, 1)
+	_, err = io.ReadFull(r, lenBytes)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	header = make([]byte, 1+int(lenBytes[0])+2)
+	header[0] = lenBytes[0]
+
+	_, err = io.ReadFull(r, header[1:])
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	host = string(header[1 : 1+lenBytes[0]])
+	port = binary.BigEndian.Uint16(header[len(header)-2:])
+
+	return header, host, port, nil
+}
+
+// createProxyRequest creates destination header of proxy dial
+func createProxyRequest(host string, port uint16) []byte {
+	header := make([]byte, 0, 1+len(host)+2)
+	header = append(header, byte(len(host)))
+	header = append(header, host...)
+	header = binary.BigEndian.AppendUint16(header, port)
+	return header
+}
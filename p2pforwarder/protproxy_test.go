@@ -0,0 +1,112 @@
+package p2pforwarder
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseProxyDestination(t *testing.T) {
+	tests := []struct {
+		s       string
+		ipnet   string
+		portMin uint16
+		portMax uint16
+		wantErr bool
+	}{
+		{s: "192.168.1.0/24", ipnet: "192.168.1.0/24", portMin: 0, portMax: 65535},
+		{s: "192.168.1.7/24", ipnet: "192.168.1.0/24", portMin: 0, portMax: 65535},
+		{s: "10.0.0.5", ipnet: "10.0.0.5/32", portMin: 0, portMax: 65535},
+		{s: "10.0.0.5:22", ipnet: "10.0.0.5/32", portMin: 22, portMax: 22},
+		{s: "10.0.0.0/8:8000-8100", ipnet: "10.0.0.0/8", portMin: 8000, portMax: 8100},
+		{s: "fd00::1", ipnet: "fd00::1/128", portMin: 0, portMax: 65535},
+		{s: "[fd00::1]:443", ipnet: "fd00::1/128", portMin: 443, portMax: 443},
+		{s: "fd00::/64:22", ipnet: "fd00::/64", portMin: 22, portMax: 22},
+		{s: "office.lan", wantErr: true},
+		{s: "10.0.0.0/33", wantErr: true},
+		{s: "10.0.0.5:http", wantErr: true},
+		{s: "10.0.0.5:70000", wantErr: true},
+		{s: "10.0.0.0/8:8100-8000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			d, err := parseProxyDestination(tt.s)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s %d-%d, want error", d.ipnet, d.portMin, d.portMax)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d.ipnet.String() != tt.ipnet || d.portMin != tt.portMin || d.portMax != tt.portMax {
+				t.Errorf("got %s %d-%d, want %s %d-%d", d.ipnet, d.portMin, d.portMax, tt.ipnet, tt.portMin, tt.portMax)
+			}
+		})
+	}
+}
+
+func TestIsDestinationAllowed(t *testing.T) {
+	p := new(openProxy)
+	for _, s := range []string{"192.168.1.0/24", "10.0.0.5:22", "10.0.0.0/8:8000-8100", "fd00::/64:443"} {
+		d, err := parseProxyDestination(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.destinations = append(p.destinations, d)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "192.168.1.20:80", want: true},
+		{addr: "192.168.2.20:80", want: false},
+		{addr: "10.0.0.5:22", want: true},
+		{addr: "10.0.0.5:23", want: false},
+		{addr: "10.1.2.3:8000", want: true},
+		{addr: "10.1.2.3:8100", want: true},
+		{addr: "10.1.2.3:8101", want: false},
+		{addr: "[::ffff:192.168.1.20]:80", want: true},
+		{addr: "[fd00::1]:443", want: true},
+		{addr: "[fd00::1]:22", want: false},
+		{addr: "[fd00:0:0:1::1]:443", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := p.isDestinationAllowed(addr.IP, uint16(addr.Port))
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenProxyOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *ProxyOptions
+		want error
+	}{
+		{name: "no options", opts: nil, want: ErrNoProxyDestinations},
+		{name: "no destinations", opts: &ProxyOptions{Secret: "mypassword"}, want: ErrNoProxyDestinations},
+		{name: "open to everyone", opts: &ProxyOptions{Destinations: []string{"192.168.1.0/24"}}, want: ErrProxyNotProtected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := new(Forwarder).OpenProxy(tt.opts)
+			if err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
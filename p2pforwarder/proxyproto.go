@@ -0,0 +1,147 @@
+package p2pforwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Ports may send PROXY protocol header to the target before connection data,
+// so the service sees the peer instead of dialsIP. The addresses are the
+// observed ones of the libp2p connection, a relayed connection has none. The
+// destination is the target itself when the connection came to a wildcard
+// listen address. The version 2 header also carries the peer id as
+// PP2_TYPE_UNIQUE_ID.
+const (
+	// ProxyProtocolV1 is the human-readable PROXY protocol header
+	ProxyProtocolV1 = 1
+	// ProxyProtocolV2 is the binary PROXY protocol header, which also carries the peer id
+	ProxyProtocolV2 = 2
+)
+
+var (
+	// ErrUnknownProxyProtocol = error "PROXY protocol version must be 1 or 2"
+	ErrUnknownProxyProtocol = errors.New("PROXY protocol version must be 1 or 2")
+	// ErrProxyProtocolUDP = error "PROXY protocol is not supported by udp ports"
+	ErrProxyProtocolUDP = errors.New("PROXY protocol is not supported by udp ports")
+)
+
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyV2Command byte = 0x21
+
+	proxyV2Unspec byte = 0x00
+	proxyV2TCP4   byte = 0x11
+	proxyV2TCP6   byte = 0x21
+
+	proxyV2TypeUniqueID byte = 0x05
+)
+
+// proxyAddr returns ip and port of `addr`, nil for relayed and other addresses without them
+func proxyAddr(addr ma.Multiaddr) *net.TCPAddr {
+	var (
+		ip   net.IP
+		port = -1
+	)
+
+	for _, c := range addr {
+		switch c.Code() {
+		case ma.P_IP4, ma.P_IP6:
+			if ip == nil {
+				ip = net.IP(c.RawValue())
+			}
+		case ma.P_TCP, ma.P_UDP:
+			if port < 0 {
+				port = int(binary.BigEndian.Uint16(c.RawValue()))
+			}
+		case ma.P_CIRCUIT:
+			return nil
+		}
+	}
+
+	if ip == nil || port < 0 {
+		return nil
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// writeProxyHeader writes PROXY protocol header of `version` describing the peer of `c` to `target`
+func writeProxyHeader(target net.Conn, version int, c network.Conn) error {
+	src := proxyAddr(c.RemoteMultiaddr())
+	dst := proxyAddr(c.LocalMultiaddr())
+	if dst != nil && dst.IP.IsUnspecified() {
+		dst, _ = target.RemoteAddr().(*net.TCPAddr)
+	}
+
+	// Both addresses must be of the same family, IPv4 ones are mapped to IPv6 when they are not
+	v4 := src != nil && dst != nil && src.IP.To4() != nil && dst.IP.To4() != nil
+
+	var header []byte
+
+	switch version {
+	case ProxyProtocolV1:
+		switch {
+		case src == nil || dst == nil:
+			header = []byte("PROXY UNKNOWN\r\n")
+		case v4:
+			header = []byte("PROXY TCP4 " + src.IP.To4().String() + " " + dst.IP.To4().String() + " " +
+				strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n")
+		default:
+			header = []byte("PROXY TCP6 " + proxyIPv6String(src.IP) + " " + proxyIPv6String(dst.IP) + " " +
+				strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n")
+		}
+	case ProxyProtocolV2:
+		var (
+			family byte
+			addrs  bytes.Buffer
+		)
+
+		switch {
+		case src == nil || dst == nil:
+			family = proxyV2Unspec
+		case v4:
+			family = proxyV2TCP4
+			addrs.Write(src.IP.To4())
+			addrs.Write(dst.IP.To4())
+		default:
+			family = proxyV2TCP6
+			addrs.Write(src.IP.To16())
+			addrs.Write(dst.IP.To16())
+		}
+		if family != proxyV2Unspec {
+			binary.Write(&addrs, binary.BigEndian, uint16(src.Port))
+			binary.Write(&addrs, binary.BigEndian, uint16(dst.Port))
+		}
+
+		peerid := []byte(c.RemotePeer().String())
+
+		addrs.WriteByte(proxyV2TypeUniqueID)
+		binary.Write(&addrs, binary.BigEndian, uint16(len(peerid)))
+		addrs.Write(peerid)
+
+		header = append(header, proxyV2Signature...)
+		header = append(header, proxyV2Command, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(addrs.Len()))
+		header = append(header, addrs.Bytes()...)
+	default:
+		return ErrUnknownProxyProtocol
+	}
+
+	_, err := target.Write(header)
+	return err
+}
+
+// proxyIPv6String formats `ip` as IPv6 address, IPv4 ones are mapped
+func proxyIPv6String(ip net.IP) string {
+	if ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
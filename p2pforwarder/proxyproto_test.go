@@ -0,0 +1,150 @@
+package p2pforwarder
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// testProxyConn is libp2p connection of the peer, only its addresses and peer id are used
+type testProxyConn struct {
+	network.Conn
+
+	remote, local ma.Multiaddr
+	peer          peer.ID
+}
+
+func (c *testProxyConn) RemoteMultiaddr() ma.Multiaddr { return c.remote }
+func (c *testProxyConn) LocalMultiaddr() ma.Multiaddr  { return c.local }
+func (c *testProxyConn) RemotePeer() peer.ID           { return c.peer }
+
+// testProxyTarget records the header written to the target
+type testProxyTarget struct {
+	net.Conn
+
+	addr *net.TCPAddr
+	b    bytes.Buffer
+}
+
+func (c *testProxyTarget) RemoteAddr() net.Addr        { return c.addr }
+func (c *testProxyTarget) Write(b []byte) (int, error) { return c.b.Write(b) }
+
+func TestWriteProxyHeader(t *testing.T) {
+	// peer.ID("peer").String() is 3sdfvR, it is sent as PP2_TYPE_UNIQUE_ID
+	uniqueID := []byte{proxyV2TypeUniqueID, 0, 6, '3', 's', 'd', 'f', 'v', 'R'}
+
+	v2 := func(family byte, addrs ...byte) []byte {
+		b := append([]byte{}, proxyV2Signature...)
+		b = append(b, proxyV2Command, family, 0, byte(len(addrs)+len(uniqueID)))
+		b = append(b, addrs...)
+		return append(b, uniqueID...)
+	}
+
+	tests := []struct {
+		name          string
+		version       int
+		remote, local string
+		want          []byte
+	}{
+		{
+			name:    "v1 ipv4",
+			version: ProxyProtocolV1,
+			remote:  "/ip4/1.2.3.4/tcp/5000",
+			local:   "/ip4/10.0.0.1/tcp/4001",
+			want:    []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5000 4001\r\n"),
+		},
+		{
+			name:    "v1 quic",
+			version: ProxyProtocolV1,
+			remote:  "/ip4/1.2.3.4/udp/5000/quic-v1",
+			local:   "/ip4/10.0.0.1/udp/4001/quic-v1",
+			want:    []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5000 4001\r\n"),
+		},
+		{
+			name:    "v1 wildcard listen address",
+			version: ProxyProtocolV1,
+			remote:  "/ip4/1.2.3.4/tcp/5000",
+			local:   "/ip4/0.0.0.0/tcp/4001",
+			want:    []byte("PROXY TCP4 1.2.3.4 127.0.0.1 5000 3389\r\n"),
+		},
+		{
+			name:    "v1 ipv6 with mapped ipv4",
+			version: ProxyProtocolV1,
+			remote:  "/ip6/2001:db8::1/tcp/5000",
+			local:   "/ip4/10.0.0.1/tcp/4001",
+			want:    []byte("PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 5000 4001\r\n"),
+		},
+		{
+			name:    "v1 relayed",
+			version: ProxyProtocolV1,
+			remote:  "/ip4/2.2.2.2/tcp/4001/p2p-circuit",
+			local:   "/ip4/10.0.0.1/tcp/4001",
+			want:    []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name:    "v2 ipv4",
+			version: ProxyProtocolV2,
+			remote:  "/ip4/1.2.3.4/tcp/5000",
+			local:   "/ip4/10.0.0.1/tcp/4001",
+			want: v2(proxyV2TCP4,
+				1, 2, 3, 4,
+				10, 0, 0, 1,
+				0x13, 0x88, 0x0F, 0xA1,
+			),
+		},
+		{
+			name:    "v2 ipv6 with mapped ipv4",
+			version: ProxyProtocolV2,
+			remote:  "/ip6/2001:db8::1/tcp/5000",
+			local:   "/ip4/10.0.0.1/tcp/4001",
+			want: v2(proxyV2TCP6,
+				0x20, 0x01, 0x0D, 0xB8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 10, 0, 0, 1,
+				0x13, 0x88, 0x0F, 0xA1,
+			),
+		},
+		{
+			name:    "v2 relayed",
+			version: ProxyProtocolV2,
+			remote:  "/ip4/2.2.2.2/tcp/4001/p2p-circuit",
+			local:   "/ip4/10.0.0.1/tcp/4001",
+			want:    v2(proxyV2Unspec),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &testProxyConn{
+				remote: ma.StringCast(tt.remote),
+				local:  ma.StringCast(tt.local),
+				peer:   peer.ID("peer"),
+			}
+			target := &testProxyTarget{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3389}}
+
+			err := writeProxyHeader(target, tt.version, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(target.b.Bytes(), tt.want) {
+				t.Errorf("got %q, want %q", target.b.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeaderUnknownVersion(t *testing.T) {
+	c := &testProxyConn{
+		remote: ma.StringCast("/ip4/1.2.3.4/tcp/5000"),
+		local:  ma.StringCast("/ip4/10.0.0.1/tcp/4001"),
+	}
+
+	err := writeProxyHeader(&testProxyTarget{}, 3, c)
+	if err != ErrUnknownProxyProtocol {
+		t.Errorf("got %v, want %v", err, ErrUnknownProxyProtocol)
+	}
+}
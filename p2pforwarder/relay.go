@@ -0,0 +1,230 @@
+package p2pforwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// connectTimeout limits both direct and relayed connection attempts
+	connectTimeout = 30 * time.Second
+
+	// maxRelayCandidates limits number of relays tried at once
+	maxRelayCandidates = 10
+)
+
+// ErrNoRelays = error "No circuit relays to connect through"
+var ErrNoRelays = errors.New("No circuit relays to connect through")
+
+// relayPeersACL lets only your own nodes use relay without limits, so it is not an open relay
+type relayPeersACL struct {
+	peers map[peer.ID]struct{}
+}
+
+func newRelayPeersACL(peerids []peer.ID) *relayPeersACL {
+	acl := &relayPeersACL{peers: make(map[peer.ID]struct{}, len(peerids))}
+	for _, peerid := range peerids {
+		acl.peers[peerid] = struct{}{}
+	}
+	return acl
+}
+
+func (acl *relayPeersACL) AllowReserve(p peer.ID, a ma.Multiaddr) bool {
+	_, ok := acl.peers[p]
+	return ok
+}
+
+func (acl *relayPeersACL) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	_, srcOk := acl.peers[src]
+	_, destOk := acl.peers[dest]
+	return srcOk && destOk
+}
+
+// newStream opens stream to `peerid` which may also go through a relayed connection
+func (f *Forwarder) newStream(ctx context.Context, peerid peer.ID, protIDs ...protocol.ID) (network.Stream, error) {
+	return f.host.NewStream(network.WithAllowLimitedConn(ctx, "p2ptunnel"), peerid, protIDs...)
+}
+
+// connectPeer connects to `peerid` directly or with hole punching, falls back
+// to circuit relays and returns description of the chosen path
+func (f *Forwarder) connectPeer(ctx context.Context, peerid peer.ID) (path string, err error) {
+	if f.host.Network().Connectedness(peerid) == network.Connected {
+		return f.connPath(peerid), nil
+	}
+
+	// Cached addresses are already in the peerstore, so they are tried before DHT lookup
+	dctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	err = f.host.Connect(dctx, peer.AddrInfo{ID: peerid})
+	cancel()
+	if err == nil {
+		f.rememberPeer(peerid)
+		return f.connPath(peerid), nil
+	}
+
+	onErrFn(fmt.Errorf("connect to %s: %s, trying circuit relays", peerid, err))
+
+	addrs := f.relayCircuitAddrs(peerid)
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("connect to %s: %s", peerid, ErrNoRelays)
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	err = f.host.Connect(network.WithAllowLimitedConn(rctx, "p2ptunnel"), peer.AddrInfo{
+		ID:    peerid,
+		Addrs: addrs,
+	})
+	if err != nil {
+		return "", fmt.Errorf("connect to %s through circuit relays: %s", peerid, err)
+	}
+
+	f.rememberPeer(peerid)
+	return f.connPath(peerid), nil
+}
+
+// relayCircuitAddrs returns circuit addresses of `peerid` through relays it
+// advertises, static relays and connected peers which provide relay service
+func (f *Forwarder) relayCircuitAddrs(peerid peer.ID) []ma.Multiaddr {
+	var addrs []ma.Multiaddr
+
+	seen := make(map[peer.ID]struct{})
+
+	addRelay := func(relay peer.ID) {
+		if relay == peerid || relay == f.host.ID() || len(addrs) >= maxRelayCandidates {
+			return
+		}
+		if _, ok := seen[relay]; ok {
+			return
+		}
+		seen[relay] = struct{}{}
+
+		addr, err := ma.NewMultiaddr("/p2p/" + relay.String() + "/p2p-circuit")
+		if err != nil {
+			return
+		}
+		addrs = append(addrs, addr)
+	}
+
+	// Relays the peer advertises
+	for _, addr := range f.host.Peerstore().Addrs(peerid) {
+		relayAddr, err := addr.ValueForProtocol(ma.P_P2P)
+		if err != nil {
+			continue
+		}
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err != nil {
+			continue
+		}
+
+		relay, err := peer.Decode(relayAddr)
+		if err != nil {
+			continue
+		}
+		addRelay(relay)
+	}
+
+	for _, relay := range f.staticRelays {
+		f.host.Peerstore().AddAddrs(relay.ID, relay.Addrs, peerstore.PermanentAddrTTL)
+		addRelay(relay.ID)
+	}
+
+	// Peers we know to provide relay service
+	for _, relay := range f.host.Network().Peers() {
+		protos, err := f.host.Peerstore().SupportsProtocols(relay, proto.ProtoIDv2Hop)
+		if err != nil || len(protos) == 0 {
+			continue
+		}
+		addRelay(relay)
+	}
+
+	for _, addr := range addrs {
+		f.host.Peerstore().AddAddr(peerid, addr, peerstore.TempAddrTTL)
+	}
+
+	return addrs
+}
+
+// connPath describes connection to `peerid`, direct connections are preferred
+func (f *Forwarder) connPath(peerid peer.ID) string {
+	path := ""
+
+	for _, c := range f.host.Network().ConnsToPeer(peerid) {
+		if !isRelayedConn(c) {
+			return "direct " + c.RemoteMultiaddr().String()
+		}
+
+		path = "relayed " + c.RemoteMultiaddr().String()
+	}
+
+	return path
+}
+
+// ConnPath describes current connection to peer `id` like "direct ADDR" or
+// "relayed ADDR", it is empty when there is no connection
+func (f *Forwarder) ConnPath(id string) string {
+	pi, err := parseConnectTarget(id)
+	if err != nil {
+		return ""
+	}
+
+	return f.connPath(pi.ID)
+}
+
+// onPeerConnected reports relayed connection of a tunnel peer upgraded to direct, e.g. by hole punching
+func (f *Forwarder) onPeerConnected(c network.Conn) {
+	if isRelayedConn(c) {
+		return
+	}
+
+	peerid := c.RemotePeer()
+
+	f.portsSubscriptionsMux.Lock()
+	_, tunneled := f.portsSubscriptions[peerid]
+	f.portsSubscriptionsMux.Unlock()
+	if !tunneled {
+		f.portsSubscribersMux.Lock()
+		_, tunneled = f.portsSubscribers[peerid]
+		f.portsSubscribersMux.Unlock()
+	}
+	if !tunneled {
+		return
+	}
+
+	relayed := false
+	for _, other := range f.host.Network().ConnsToPeer(peerid) {
+		if other == c {
+			continue
+		}
+		if !isRelayedConn(other) {
+			// It is already direct
+			return
+		}
+		relayed = true
+	}
+
+	if relayed {
+		onInfoFn("Connection to " + peerid.String() + " upgraded from relayed to direct " + c.RemoteMultiaddr().String())
+	}
+}
+
+// connKind tells whether `c` is "direct" or "relayed"
+func connKind(c network.Conn) string {
+	if isRelayedConn(c) {
+		return "relayed"
+	}
+	return "direct"
+}
+
+func isRelayedConn(c network.Conn) bool {
+	_, err := c.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
@@ -0,0 +1,276 @@
+package p2pforwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SOCKS5 server of the connecting side sends CONNECT requests to the peer
+// over proxy dial, see proxyProtID. Only the no authentication method is
+// supported, so it should listen on a loopback address.
+const (
+	socks5Version byte = 0x05
+
+	socks5MethodNoAuth       byte = 0x00
+	socks5MethodNoAcceptable byte = 0xFF
+
+	socks5CmdConnect byte = 0x01
+
+	socks5AddrIPv4   byte = 0x01
+	socks5AddrDomain byte = 0x03
+	socks5AddrIPv6   byte = 0x04
+)
+
+// SOCKS5 reply codes, the proxy handler answers with them too
+const (
+	socks5Succeeded           byte = 0x00
+	socks5GeneralFailure      byte = 0x01
+	socks5NotAllowed          byte = 0x02
+	socks5NetworkUnreachable  byte = 0x03
+	socks5HostUnreachable     byte = 0x04
+	socks5ConnectionRefused   byte = 0x05
+	socks5CommandNotSupported byte = 0x07
+	socks5AddrNotSupported    byte = 0x08
+)
+
+var socks5ReplyStrings = map[byte]string{
+	socks5GeneralFailure:      "general failure",
+	socks5NotAllowed:          "destination is not allowed",
+	socks5NetworkUnreachable:  "network unreachable",
+	socks5HostUnreachable:     "host unreachable",
+	socks5ConnectionRefused:   "connection refused",
+	socks5CommandNotSupported: "command not supported",
+	socks5AddrNotSupported:    "address type not supported",
+}
+
+// socks5HandshakeTimeout limits reading SOCKS5 greeting and request
+const socks5HandshakeTimeout = 30 * time.Second
+
+// serveSOCKS5 sends connections accepted by `ln` to destinations they request through `peerid` until `ctx` is done
+func (f *Forwarder) serveSOCKS5(ctx context.Context, ln net.Listener, peerid peer.ID, opts *ConnectOptions) {
+	onInfoFn("Listening socks5 " + ln.Addr().String() + " -> " + peerid.String())
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-f.closing:
+		}
+		ln.Close()
+
+		onInfoFn("Closed socks5 " + ln.Addr().String())
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.closing:
+				return
+			default:
+				onErrFn(fmt.Errorf("socks5: %s", err))
+				continue
+			}
+		}
+
+		if !f.startPipe() {
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer f.pipes.Done()
+
+			f.handleSOCKS5(ctx, conn, peerid, opts)
+		}()
+	}
+}
+
+func (f *Forwarder) handleSOCKS5(ctx context.Context, conn net.Conn, peerid peer.ID, opts *ConnectOptions) {
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	host, port, reply, err := readSOCKS5Request(conn)
+	if err != nil {
+		if reply != socks5Succeeded {
+			writeSOCKS5Reply(conn, reply)
+		}
+		conn.Close()
+		onErrFn(fmt.Errorf("socks5: %s from %s", err, conn.RemoteAddr()))
+		return
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	s, reply, err := f.openProxyStream(ctx, peerid, host, port, opts)
+	if err != nil {
+		writeSOCKS5Reply(conn, reply)
+		conn.Close()
+		onErrFn(fmt.Errorf("socks5: %s to %s", err, addr))
+		return
+	}
+
+	err = writeSOCKS5Reply(conn, socks5Succeeded)
+	if err != nil {
+		conn.Close()
+		s.Reset()
+		onErrFn(fmt.Errorf("socks5: %s", err))
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	onInfoFn("Accepted socks5 connection from " + conn.RemoteAddr().String() + " to " + addr + " through " + connKind(s.Conn()) + " connection")
+	defer onInfoFn("Closed socks5 connection from " + conn.RemoteAddr().String() + " to " + addr)
+
+	pipeBothIOsAndClose(ctx, conn, s)
+}
+
+// readSOCKS5Request negotiates method and reads CONNECT request, the reply code
+// must be sent when it is not socks5Succeeded
+func readSOCKS5Request(conn net.Conn) (host string, port uint16, reply byte, err error) {
+	b := make([]byte, 2)
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		return "", 0, socks5Succeeded, err
+	}
+	if b[0] != socks5Version {
+		return "", 0, socks5Succeeded, fmt.Errorf("unsupported version %d", b[0])
+	}
+
+	methods := make([]byte, b[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", 0, socks5Succeeded, err
+	}
+
+	if bytes.IndexByte(methods, socks5MethodNoAuth) < 0 {
+		conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return "", 0, socks5Succeeded, errors.New("no acceptable auth method")
+	}
+
+	_, err = conn.Write([]byte{socks5Version, socks5MethodNoAuth})
+	if err != nil {
+		return "", 0, socks5Succeeded, err
+	}
+
+	// Version, command, reserved and address type
+	b = make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		return "", 0, socks5Succeeded, err
+	}
+	if b[0] != socks5Version {
+		return "", 0, socks5GeneralFailure, fmt.Errorf("unsupported request version %d", b[0])
+	}
+	if b[1] != socks5CmdConnect {
+		return "", 0, socks5CommandNotSupported, fmt.Errorf("unsupported command %d", b[1])
+	}
+
+	switch b[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if b[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(conn, ip)
+		host = ip.String()
+	case socks5AddrDomain:
+		host, err = readSOCKS5Domain(conn)
+	default:
+		return "", 0, socks5AddrNotSupported, fmt.Errorf("unsupported address type %d", b[3])
+	}
+	if err != nil {
+		return "", 0, socks5Succeeded, err
+	}
+
+	portBytes := make([]byte, 2)
+	_, err = io.ReadFull(conn, portBytes)
+	if err != nil {
+		return "", 0, socks5Succeeded, err
+	}
+
+	return host, binary.BigEndian.Uint16(portBytes), socks5Succeeded, nil
+}
+
+// readSOCKS5Domain reads domain name of a request, it is prefixed with its length
+func readSOCKS5Domain(r io.Reader) (string, error) {
+	lenBytes := make([]byte, 1)
+	_, err := io.ReadFull(r, lenBytes)
+	if err != nil {
+		return "", err
+	}
+	if lenBytes[0] == 0 {
+		return "", errors.New("empty domain name")
+	}
+
+	b := make([]byte, lenBytes[0])
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// writeSOCKS5Reply writes reply with zero bound address, clients do not need it to CONNECT
+func writeSOCKS5Reply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socks5Version, reply, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// openProxyStream opens proxy dial stream to `host`:`port` through `peerid`, it returns SOCKS5 reply code on error
+func (f *Forwarder) openProxyStream(ctx context.Context, peerid peer.ID, host string, port uint16, opts *ConnectOptions) (network.Stream, byte, error) {
+	s, err := f.newStream(ctx, peerid, proxyProtID)
+	if err != nil {
+		return nil, socks5GeneralFailure, err
+	}
+
+	header := createProxyRequest(host, port)
+
+	_, err = s.Write(header)
+	if err != nil {
+		s.Reset()
+		return nil, socks5GeneralFailure, err
+	}
+
+	err = answerDialChallenge(s, opts.secret(), header, f.host.ID())
+	if err != nil {
+		s.Reset()
+		return nil, socks5GeneralFailure, err
+	}
+
+	// The handler resolves and dials the destination before it replies
+	s.SetReadDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(s, reply)
+	if err != nil {
+		s.Reset()
+		return nil, socks5GeneralFailure, err
+	}
+
+	s.SetReadDeadline(time.Time{})
+
+	if reply[0] != socks5Succeeded {
+		s.Close()
+
+		str, ok := socks5ReplyStrings[reply[0]]
+		if !ok {
+			str = "reply " + strconv.Itoa(int(reply[0]))
+		}
+		return nil, reply[0], errors.New(str)
+	}
+
+	return s, socks5Succeeded, nil
+}
@@ -0,0 +1,121 @@
+package p2pforwarder
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// testSOCKS5Conn reads the client's bytes and records the server's ones
+type testSOCKS5Conn struct {
+	net.Conn
+
+	r *bytes.Reader
+	w bytes.Buffer
+}
+
+func (c *testSOCKS5Conn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *testSOCKS5Conn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func TestReadSOCKS5Request(t *testing.T) {
+	greeting := []byte{socks5Version, 1, socks5MethodNoAuth}
+	noAuth := []byte{socks5Version, socks5MethodNoAuth}
+
+	request := func(b ...byte) []byte {
+		return append(append([]byte{}, greeting...), b...)
+	}
+
+	tests := []struct {
+		name    string
+		b       []byte
+		host    string
+		port    uint16
+		reply   byte
+		written []byte
+		wantErr bool
+	}{
+		{
+			name:    "ipv4",
+			b:       request(socks5Version, socks5CmdConnect, 0, socks5AddrIPv4, 192, 168, 1, 20, 0, 80),
+			host:    "192.168.1.20",
+			port:    80,
+			written: noAuth,
+		},
+		{
+			name: "ipv6",
+			b: request(socks5Version, socks5CmdConnect, 0, socks5AddrIPv6,
+				0xFD, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xBB),
+			host:    "fd00::1",
+			port:    443,
+			written: noAuth,
+		},
+		{
+			name:    "domain",
+			b:       request(socks5Version, socks5CmdConnect, 0, socks5AddrDomain, 10, 'o', 'f', 'f', 'i', 'c', 'e', '.', 'l', 'a', 'n', 0x1F, 0x90),
+			host:    "office.lan",
+			port:    8080,
+			written: noAuth,
+		},
+		{
+			name:    "auth methods only",
+			b:       []byte{socks5Version, 2, 0x01, 0x02},
+			written: []byte{socks5Version, socks5MethodNoAcceptable},
+			wantErr: true,
+		},
+		{
+			name:    "socks4 greeting",
+			b:       []byte{0x04, socks5CmdConnect, 0, 80},
+			wantErr: true,
+		},
+		{
+			name:    "request version",
+			b:       request(0x04, socks5CmdConnect, 0, socks5AddrIPv4, 192, 168, 1, 20, 0, 80),
+			reply:   socks5GeneralFailure,
+			written: noAuth,
+			wantErr: true,
+		},
+		{
+			name:    "bind command",
+			b:       request(socks5Version, 0x02, 0, socks5AddrIPv4, 192, 168, 1, 20, 0, 80),
+			reply:   socks5CommandNotSupported,
+			written: noAuth,
+			wantErr: true,
+		},
+		{
+			name:    "unknown address type",
+			b:       request(socks5Version, socks5CmdConnect, 0, 0x02, 192, 168, 1, 20, 0, 80),
+			reply:   socks5AddrNotSupported,
+			written: noAuth,
+			wantErr: true,
+		},
+		{
+			name:    "empty domain",
+			b:       request(socks5Version, socks5CmdConnect, 0, socks5AddrDomain, 0, 0, 80),
+			written: noAuth,
+			wantErr: true,
+		},
+		{
+			name:    "truncated port",
+			b:       request(socks5Version, socks5CmdConnect, 0, socks5AddrIPv4, 192, 168, 1, 20, 0),
+			written: noAuth,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &testSOCKS5Conn{r: bytes.NewReader(tt.b)}
+
+			host, port, reply, err := readSOCKS5Request(conn)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if host != tt.host || port != tt.port || reply != tt.reply {
+				t.Errorf("got %q %d reply %d, want %q %d reply %d", host, port, reply, tt.host, tt.port, tt.reply)
+			}
+			if !bytes.Equal(conn.w.Bytes(), tt.written) {
+				t.Errorf("wrote %x, want %x", conn.w.Bytes(), tt.written)
+			}
+		})
+	}
+}
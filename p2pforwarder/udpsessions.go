@@ -0,0 +1,345 @@
+package p2pforwarder
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// UDP has no connections, so both ends keep a table of sessions per port.
+// On the side listening for Connect a session is a source address of local
+// datagrams, on the side of an opened port it is a stream from the peer with
+// its own socket. A session is closed when no datagram passes it in either
+// direction for the idle timeout.
+const (
+	// DefaultUDPIdleTimeout is used when idle timeout of UDP sessions is not set
+	DefaultUDPIdleTimeout = 2 * time.Minute
+	// DefaultUDPMaxSessions is used when max number of UDP sessions of a port is not set
+	DefaultUDPMaxSessions = 256
+
+	// udpSessionQueueLen is number of datagrams waiting to be sent to the peer, extra ones are dropped
+	udpSessionQueueLen = 64
+
+	// udpSessionRetryDelay is how long a session whose stream could not be opened drops
+	// datagrams of its source, so a client resending them does not open a stream for each
+	udpSessionRetryDelay = 5 * time.Second
+)
+
+// ErrMaxUDPSessions = error "Max UDP sessions of the port reached"
+var ErrMaxUDPSessions = errors.New("Max UDP sessions of the port reached")
+
+// UDPStats - statistics of UDP sessions of a port. Sent datagrams go to the peer, received ones come from it
+type UDPStats struct {
+	// Peer is the remote peer of a port listened by Connect, it is empty for ports opened with OpenPort
+	Peer string `json:"peer,omitempty"`
+	// Port is the remote port for ports listened by Connect
+	Port uint16 `json:"port"`
+
+	Sessions         int    `json:"sessions"`
+	TotalSessions    uint64 `json:"total_sessions"`
+	ExpiredSessions  uint64 `json:"expired_sessions"`
+	RejectedSessions uint64 `json:"rejected_sessions"`
+
+	DatagramsSent     uint64 `json:"datagrams_sent"`
+	DatagramsReceived uint64 `json:"datagrams_received"`
+	DatagramsDropped  uint64 `json:"datagrams_dropped"`
+	BytesSent         uint64 `json:"bytes_sent"`
+	BytesReceived     uint64 `json:"bytes_received"`
+
+	// QUICDatagramsSent and QUICDatagramsReceived are the datagrams which went as QUIC datagrams instead of the dial stream
+	QUICDatagramsSent     uint64 `json:"quic_datagrams_sent"`
+	QUICDatagramsReceived uint64 `json:"quic_datagrams_received"`
+}
+
+type udpSessionTable struct {
+	peer peer.ID
+	port uint16
+
+	idleTimeout time.Duration
+	maxSessions int
+
+	sessions map[string]*udpSession
+	// rejected holds keys rejected since the table was last not full, so each is reported once
+	rejected map[string]struct{}
+	mux      sync.Mutex
+
+	totalSessions    atomic.Uint64
+	expiredSessions  atomic.Uint64
+	rejectedSessions atomic.Uint64
+
+	datagramsSent     atomic.Uint64
+	datagramsReceived atomic.Uint64
+	datagramsDropped  atomic.Uint64
+	bytesSent         atomic.Uint64
+	bytesReceived     atomic.Uint64
+
+	quicDatagramsSent     atomic.Uint64
+	quicDatagramsReceived atomic.Uint64
+}
+
+type udpSession struct {
+	table *udpSessionTable
+	key   string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// lastActive is unix time in nanoseconds of the last datagram
+	lastActive atomic.Int64
+	// failedAt is unix time in nanoseconds when the stream of the session could not be opened, zero when it was not
+	failedAt atomic.Int64
+
+	// queue holds datagrams to send to the peer, it is used by the side listening for Connect
+	queue chan []byte
+
+	// sendQUIC sends datagram to the peer as QUIC datagram, it is nil when the peer does not support them
+	sendQUIC func(b []byte) bool
+}
+
+// newUDPSessionTable creates table of `port`, zero `idleTimeout` and `maxSessions` mean defaults
+func newUDPSessionTable(peerid peer.ID, port uint16, idleTimeout time.Duration, maxSessions int) *udpSessionTable {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultUDPIdleTimeout
+	}
+	if maxSessions <= 0 {
+		maxSessions = DefaultUDPMaxSessions
+	}
+
+	return &udpSessionTable{
+		peer: peerid,
+		port: port,
+
+		idleTimeout: idleTimeout,
+		maxSessions: maxSessions,
+
+		sessions: make(map[string]*udpSession),
+		rejected: make(map[string]struct{}),
+	}
+}
+
+// add creates session `key` which lasts until `ctx` is done, it returns nil when the table is full
+func (t *udpSessionTable) add(ctx context.Context, key string) *udpSession {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if len(t.sessions) >= t.maxSessions {
+		t.rejectedSessions.Add(1)
+		return nil
+	}
+	clear(t.rejected)
+
+	sess := &udpSession{
+		table: t,
+		key:   key,
+		queue: make(chan []byte, udpSessionQueueLen),
+	}
+	sess.ctx, sess.cancel = context.WithCancel(ctx)
+	sess.lastActive.Store(time.Now().UnixNano())
+
+	t.sessions[key] = sess
+	t.totalSessions.Add(1)
+
+	return sess
+}
+
+// firstRejection tells whether `key` is rejected for the first time since the table was last not full,
+// at most max sessions keys are remembered, the rest are counted only
+func (t *udpSessionTable) firstRejection(key string) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	_, ok := t.rejected[key]
+	if ok || len(t.rejected) >= t.maxSessions {
+		return false
+	}
+
+	t.rejected[key] = struct{}{}
+	return true
+}
+
+// get returns session `key`, a failed session is deleted once udpSessionRetryDelay passes, so a new one can be started
+func (t *udpSessionTable) get(key string) *udpSession {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	sess := t.sessions[key]
+	if sess != nil && sess.failedBefore(time.Now().Add(-udpSessionRetryDelay).UnixNano()) {
+		delete(t.sessions, key)
+		return nil
+	}
+
+	return sess
+}
+
+// fail closes `sess` whose stream could not be opened, it is kept in the table for udpSessionRetryDelay
+func (t *udpSessionTable) fail(sess *udpSession) {
+	sess.failedAt.Store(time.Now().UnixNano())
+	sess.cancel()
+}
+
+// remove closes `sess` and deletes it from the table
+func (t *udpSessionTable) remove(sess *udpSession) {
+	sess.cancel()
+
+	t.mux.Lock()
+	if t.sessions[sess.key] == sess {
+		delete(t.sessions, sess.key)
+	}
+	t.mux.Unlock()
+}
+
+// expireIdle closes sessions idle for longer than idle timeout until `ctx` is done or `closing` is closed
+func (t *udpSessionTable) expireIdle(ctx context.Context, closing <-chan struct{}) {
+	ticker := time.NewTicker(t.idleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-closing:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		deadline := now.Add(-t.idleTimeout).UnixNano()
+		retryDeadline := now.Add(-udpSessionRetryDelay).UnixNano()
+
+		t.mux.Lock()
+		for key, sess := range t.sessions {
+			if sess.failedBefore(retryDeadline) {
+				delete(t.sessions, key)
+				continue
+			}
+			if sess.lastActive.Load() < deadline {
+				sess.cancel()
+				delete(t.sessions, key)
+				t.expiredSessions.Add(1)
+			}
+		}
+		t.mux.Unlock()
+	}
+}
+
+func (t *udpSessionTable) closeAll() {
+	t.mux.Lock()
+	for key, sess := range t.sessions {
+		sess.cancel()
+		delete(t.sessions, key)
+	}
+	t.mux.Unlock()
+}
+
+func (t *udpSessionTable) stats() UDPStats {
+	t.mux.Lock()
+	sessions := len(t.sessions)
+	t.mux.Unlock()
+
+	st := UDPStats{
+		Port: t.port,
+
+		Sessions:         sessions,
+		TotalSessions:    t.totalSessions.Load(),
+		ExpiredSessions:  t.expiredSessions.Load(),
+		RejectedSessions: t.rejectedSessions.Load(),
+
+		DatagramsSent:     t.datagramsSent.Load(),
+		DatagramsReceived: t.datagramsReceived.Load(),
+		DatagramsDropped:  t.datagramsDropped.Load(),
+		BytesSent:         t.bytesSent.Load(),
+		BytesReceived:     t.bytesReceived.Load(),
+
+		QUICDatagramsSent:     t.quicDatagramsSent.Load(),
+		QUICDatagramsReceived: t.quicDatagramsReceived.Load(),
+	}
+	if t.peer != "" {
+		st.Peer = t.peer.String()
+	}
+
+	return st
+}
+
+// failedBefore tells whether stream of `sess` could not be opened before unix time `deadline` in nanoseconds
+func (sess *udpSession) failedBefore(deadline int64) bool {
+	failedAt := sess.failedAt.Load()
+	return failedAt != 0 && failedAt < deadline
+}
+
+// sent counts datagram of `n` bytes sent to the peer
+func (sess *udpSession) sent(n int) {
+	sess.lastActive.Store(time.Now().UnixNano())
+	sess.table.datagramsSent.Add(1)
+	sess.table.bytesSent.Add(uint64(n))
+}
+
+// received counts datagram of `n` bytes received from the peer
+func (sess *udpSession) received(n int) {
+	sess.lastActive.Store(time.Now().UnixNano())
+	sess.table.datagramsReceived.Add(1)
+	sess.table.bytesReceived.Add(uint64(n))
+}
+
+// sendOverQUIC sends datagram `b` to the peer as QUIC datagram, false means it must go over the dial stream
+func (sess *udpSession) sendOverQUIC(b []byte) bool {
+	if sess.sendQUIC == nil || !sess.sendQUIC(b) {
+		return false
+	}
+
+	sess.table.quicDatagramsSent.Add(1)
+	sess.sent(len(b))
+	return true
+}
+
+// enqueue queues datagram `b` to be sent to the peer, it is dropped when the queue is full
+func (sess *udpSession) enqueue(b []byte) {
+	if sess.failedAt.Load() != 0 {
+		sess.table.datagramsDropped.Add(1)
+		return
+	}
+
+	select {
+	case sess.queue <- b:
+	default:
+		sess.table.datagramsDropped.Add(1)
+	}
+}
+
+// runUDPSessionTable makes `t` visible in UDPStats and expires its idle sessions until `ctx`
+// is done. Datagrams are not worth waiting for on shutdown, so the sessions are closed then
+func (f *Forwarder) runUDPSessionTable(ctx context.Context, t *udpSessionTable) {
+	f.udpTablesMux.Lock()
+	f.udpTables[t] = struct{}{}
+	f.udpTablesMux.Unlock()
+
+	t.expireIdle(ctx, f.closing)
+	t.closeAll()
+
+	f.udpTablesMux.Lock()
+	delete(f.udpTables, t)
+	f.udpTablesMux.Unlock()
+}
+
+// UDPStats returns statistics of UDP sessions of opened ports and ports listened by Connect
+func (f *Forwarder) UDPStats() []UDPStats {
+	f.udpTablesMux.Lock()
+	stats := make([]UDPStats, 0, len(f.udpTables))
+	for t := range f.udpTables {
+		stats = append(stats, t.stats())
+	}
+	f.udpTablesMux.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Peer != stats[j].Peer {
+			return stats[i].Peer < stats[j].Peer
+		}
+		return stats[i].Port < stats[j].Port
+	})
+
+	return stats
+}